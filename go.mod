@@ -1,8 +1,14 @@
 module github.com/igorxp5/dyllable
 
-go 1.17
+go 1.18
 
 require (
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/google/uuid v1.3.0
-	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd
+	golang.org/x/net v0.1.0
+)
+
+require (
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/sys v0.1.0 // indirect
 )
@@ -1,5 +1,408 @@
 package main
 
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/igorxp5/dyllable/network"
+)
+
+const usage = `usage: dyllable <command> [flags]
+
+commands:
+  node      run a peer until interrupted
+  discover  send a DISCOVERY packet and list the RUNNING-APP responders
+  send      send a RequestActionPacket to host:port and print the response
+  decode    read raw packets from stdin and pretty-print them
+`
+
+const echoActionId = 0
+const runningAppType = "RUNNING-APP"
+
 func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "node":
+		err = runNode(ctx, os.Args[2:])
+	case "discover":
+		err = runDiscover(ctx, os.Args[2:], os.Stdout)
+	case "send":
+		err = runSend(ctx, os.Args[2:])
+	case "decode":
+		err = runDecode(os.Stdin, os.Stdout)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dyllable: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runNode(ctx context.Context, args []string) (err error) {
+	flags := flag.NewFlagSet("node", flag.ExitOnError)
+	appAddress := flags.String("app", "0.0.0.0:8401", "TCP address to accept actions on")
+	discoveryAddress := flags.String("discovery", "0.0.0.0:8400", "UDP address to answer discovery requests on, or a multicast group")
+	lookupAddress := flags.String("lookup", "255.255.255.255:8400", "UDP address to send discovery requests to")
+	ifaceNames := flags.String("interface", "", "comma separated network interfaces to run discovery on (default every interface that is up)")
+	codecName := flags.String("codec", "text", "codec for discovery and calls to other nodes: text or binary")
+	lobbyKey := flags.String("lobby-key", "", "sign and verify every packet with this lobby secret")
+	identityPath := flags.String("identity", "", "file holding the node Ed25519 key, created when missing (default in the user config directory)")
+	encrypted := flags.Bool("encrypt", false, "accept and make calls only over TLS sessions pinned to discovered node IDs")
+	trust := flags.String("trust", "", "comma separated node IDs accepted for TLS sessions without being discovered, such as the one send uses")
+	reconnect := flags.Bool("reconnect", false, "redial dropped peers and replay their unanswered calls")
+	heartbeat := flags.Duration("heartbeat", 0, "ping connected peers at this interval and report the ones that stop answering")
+	name := flags.String("name", "", "player or host name advertised in discovery")
+	game := flags.String("game", "", "game mode advertised in discovery")
+	lobbyID := flags.String("lobby-id", "", "lobby id advertised in discovery")
+	maxPlayers := flags.Uint("max-players", 0, "lobby capacity advertised in discovery")
+	language := flags.String("language", "", "lobby language advertised in discovery")
+	probeInterval := flags.Duration("probe-interval", network.DefaultDiscoveryConfig.ProbeInterval, "how often to send discovery requests after the first burst")
+	flags.Parse(args)
+
+	codec, err := parseCodec(*codecName, *lobbyKey)
+	if err != nil {
+		return
+	}
+
+	appSocket, err := net.ResolveTCPAddr("tcp", *appAddress)
+	if err != nil {
+		return
+	}
+	discoverySocket, err := net.ResolveUDPAddr("udp", *discoveryAddress)
+	if err != nil {
+		return
+	}
+	lookupSocket, err := net.ResolveUDPAddr("udp", *lookupAddress)
+	if err != nil {
+		return
+	}
+	identity, err := loadIdentity(*identityPath)
+	if err != nil {
+		return
+	}
+	var trusted []ed25519.PublicKey
+	for _, trustedID := range splitList(*trust) {
+		nodeID, err := network.ParseNodeID(trustedID)
+		if err != nil {
+			return fmt.Errorf("invalid trust: %v", err)
+		}
+		trusted = append(trusted, nodeID)
+	}
+	metadata := network.DiscoveryMetadata{Name: *name, Game: *game, LobbyID: *lobbyID, MaxPlayers: uint16(*maxPlayers), Language: *language}
+	config := network.NodeConfig{
+		AppSocket:       appSocket,
+		DiscoverySocket: discoverySocket,
+		LookupAddress:   lookupSocket,
+		Encrypted:       *encrypted,
+		Trusted:         trusted,
+		PeerEvents:      make(chan network.PeerEvent),
+		Discovery: network.DiscoveryConfig{
+			ProbeInterval: *probeInterval,
+			Interfaces:    splitList(*ifaceNames),
+			Codec:         codec,
+			Identity:      identity,
+			Metadata:      func() network.DiscoveryMetadata { return metadata },
+		},
+	}
+	if *reconnect {
+		config.Reconnect = &network.DefaultReconnectConfig
+	}
+	if *heartbeat > 0 {
+		config.Liveness = &network.LivenessConfig{Interval: *heartbeat}
+	}
+	if discoverySocket.IP.IsMulticast() {
+		multicast := multicastConfig()
+		config.Discovery.Multicast = &multicast
+		config.LookupAddress = discoverySocket
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	router := network.NewActionRouter()
+	router.Use(network.LoggingMiddleware(logger))
+	router.Handle(echoActionId, func(ctx context.Context, request *network.RequestActionPacket) network.ResponseActionPacket {
+		return network.NewResponseActionPacket(request.RequestUUID, true, request.Parameters)
+	})
+
+	node := network.NewNode(config, router)
+	err = node.Start(ctx)
+	if err != nil {
+		return
+	}
+	logger.Printf("node %s running on %s", network.FormatNodeID(node.NodeID()), node.AppSocket())
+
+	for {
+		select {
+		case event := <-config.PeerEvents:
+			peer := &network.DiscoveredNode{Address: event.Peer.Address, NodeID: event.Peer.NodeID}
+			if event.Err != nil {
+				logger.Printf("peer %s %s: %v", peer, event.Type, event.Err)
+				continue
+			}
+			logger.Printf("peer %s %s", peer, event.Type)
+		case <-ctx.Done():
+			logger.Print("stopping node")
+			return node.Stop()
+		}
+	}
+}
+
+func runDiscover(ctx context.Context, args []string, writer io.Writer) (err error) {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	address := flags.String("address", "255.255.255.255:8400", "UDP address to send the DISCOVERY packet to, may be a multicast group")
+	timeout := flags.Duration("timeout", 2*time.Second, "how long to wait for responses")
+	game := flags.String("game", "", "only list lobbies of this game mode")
+	lobbyID := flags.String("lobby-id", "", "only list the lobby with this id")
+	language := flags.String("language", "", "only list lobbies in this language")
+	minFreeSlots := flags.Uint("min-free-slots", 0, "only list lobbies with at least this many free slots")
+	codecName := flags.String("codec", "text", "codec of the request and responses: text or binary")
+	lobbyKey := flags.String("lobby-key", "", "sign the request and verify the responses with this lobby secret")
+	flags.Parse(args)
+
+	codec, err := parseCodec(*codecName, *lobbyKey)
+	if err != nil {
+		return
+	}
+	dstAddress, err := net.ResolveUDPAddr("udp", *address)
+	if err != nil {
+		return
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	localAddress := conn.LocalAddr().(*net.UDPAddr)
+	request := network.NewRequestDiscoveryPacket(localAddress.IP, uint16(localAddress.Port))
+	request.Query = network.DiscoveryQuery{Game: *game, LobbyID: *lobbyID, Language: *language, MinFreeSlots: uint16(*minFreeSlots)}
+	requestBytes, err := codec.Encode(&request)
+	if err != nil {
+		return
+	}
+	sent := time.Now()
+	_, err = conn.WriteTo(requestBytes, dstAddress)
+	if err != nil {
+		return
+	}
+
+	deadline := sent.Add(*timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	err = conn.SetReadDeadline(deadline)
+	if err != nil {
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	found := 0
+	readBuffer := make([]byte, network.DefaultDiscoveryConfig.ReadBufferSize)
+	for {
+		read, addr, err := conn.ReadFrom(readBuffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return err
+		}
+		packet, err := codec.Decode(bytes.NewBuffer(readBuffer[:read]))
+		if err != nil {
+			continue
+		}
+		response, ok := packet.(*network.DiscoveryPacket)
+		if !ok || response.Type != runningAppType || !request.Query.Matches(response.Metadata) {
+			continue
+		}
+		found++
+		host := net.JoinHostPort(response.Address.String(), fmt.Sprint(response.Port))
+		latency := time.Since(sent).Round(time.Microsecond)
+		version, err := response.NegotiateVersion()
+		if err != nil {
+			fmt.Fprintf(writer, "%-30s from %-30s %-12s %v\n", host, addr, latency, err)
+			continue
+		}
+		identity := "unsigned"
+		if response.NodeID != nil {
+			identity = "node " + network.FormatNodeID(response.NodeID)
+			if err := response.Verify(); err != nil {
+				identity = err.Error()
+			}
+		}
+		fmt.Fprintf(writer, "%-30s from %-30s %-12s version %d %s", host, addr, latency, version, identity)
+		if !response.Metadata.IsZero() {
+			fmt.Fprintf(writer, " %s", response.Metadata)
+		}
+		fmt.Fprintln(writer)
+	}
+	if found == 0 {
+		fmt.Fprintln(writer, "no nodes found")
+	}
+	return nil
+}
+
+func runSend(ctx context.Context, args []string) (err error) {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	actionId := flags.Uint("action", 0, "ACTION-ID of the request")
+	parameters := flags.String("params", "", "JSON object with the request parameters")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for the response")
+	codecName := flags.String("codec", "text", "codec of the request: text or binary")
+	lobbyKey := flags.String("lobby-key", "", "sign the request and verify the response with this lobby secret")
+	nodeID := flags.String("node-id", "", "send over TLS to the node with this ID, as printed by discover. The node must be started with -trust for the ID of -identity")
+	identityPath := flags.String("identity", "", "file holding the Ed25519 key for TLS sessions (default in the user config directory)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("send expects exactly one host:port argument")
+	}
+	if *actionId > 255 {
+		return errors.New("action must be between 0 and 255")
+	}
+	codec, err := parseCodec(*codecName, *lobbyKey)
+	if err != nil {
+		return
+	}
+	var parametersJSON map[string]interface{}
+	if *parameters != "" {
+		err = json.Unmarshal([]byte(*parameters), &parametersJSON)
+		if err != nil {
+			return fmt.Errorf("invalid params: %v", err)
+		}
+	}
+
+	dialer := net.Dialer{Timeout: *timeout}
+	var conn net.Conn
+	var identity ed25519.PrivateKey
+	if *nodeID == "" {
+		conn, err = dialer.DialContext(ctx, "tcp", flags.Arg(0))
+	} else {
+		identity, err = loadIdentity(*identityPath)
+		if err != nil {
+			return
+		}
+		conn, err = dialSession(ctx, &dialer, flags.Arg(0), *nodeID, identity)
+	}
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	client := network.NewActionClient(conn, *timeout)
+	client.SetCodec(codec)
+	go client.Serve(conn)
+
+	response, err := client.Call(ctx, uint8(*actionId), parametersJSON)
+	if err != nil && identity != nil && !errors.Is(err, context.DeadlineExceeded) {
+		//Nodes refuse sessions they can't place only once the handshake is over, so the call is what fails
+		ownID := network.FormatNodeID(identity.Public().(ed25519.PublicKey))
+		return fmt.Errorf("session refused, the node only accepts discovered node IDs and the ones given to -trust (this is node %s): %w", ownID, err)
+	}
+	if err != nil {
+		return
+	}
+	return printPacket(os.Stdout, response)
+}
+
+func runDecode(reader io.Reader, writer io.Writer) error {
+	decoder := network.NewPacketDecoder(reader)
+	for {
+		packet, err := decoder.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = printPacket(writer, packet)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func loadIdentity(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(configDir, "dyllable", "node.key")
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return network.LoadNodeIdentity(path)
+}
+
+func dialSession(ctx context.Context, dialer *net.Dialer, address string, nodeID string, identity ed25519.PrivateKey) (net.Conn, error) {
+	pinnedPeer, err := network.ParseNodeID(nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node-id: %v", err)
+	}
+	sessionConfig, err := network.NewSessionTLSConfig(identity, pinnedPeer)
+	if err != nil {
+		return nil, err
+	}
+	tlsDialer := tls.Dialer{NetDialer: dialer, Config: sessionConfig}
+	return tlsDialer.DialContext(ctx, "tcp", address)
+}
+
+func parseCodec(name string, lobbyKey string) (network.Codec, error) {
+	if lobbyKey == "" {
+		return network.ParseCodec(name)
+	}
+	if name != "text" {
+		return nil, errors.New("signed packets are only supported by the text codec")
+	}
+	return network.NewSignedCodec([]byte(lobbyKey)), nil
+}
+
+func printPacket(writer io.Writer, packet network.Packet) error {
+	packetJSON, err := json.MarshalIndent(packet, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(writer, "%T %s\n", packet, packetJSON)
+	return err
+}
+
+// Multicast stays on the local network. Requests go out of each selected interface
+func multicastConfig() network.MulticastConfig {
+	return network.MulticastConfig{TTL: 1, Loopback: true}
+}
 
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/igorxp5/dyllable/network"
+)
+
+func TestRunDecode(t *testing.T) {
+	input := "DYLLABLE-DISCOVERY\r\n" +
+		"TYPE: RUNNING-APP\r\n" +
+		"HOST: 127.0.0.1:8400\r\n" +
+		"\r\n" +
+		"DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: 95bcd112-c138-4ca6-9df9-f4c508b9c0c1\r\n" +
+		"ACTION-ID: 3\r\n" +
+		"\r\n" +
+		"{\"key\":\"value\"}\r\n" +
+		"\r\n"
+	var output bytes.Buffer
+	err := runDecode(strings.NewReader(input), &output)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, expected := range []string{
+		"*network.DiscoveryPacket",
+		"\"Address\": \"127.0.0.1\"",
+		"\"Type\": \"RUNNING-APP\"",
+		"*network.RequestActionPacket",
+		"\"RequestUUID\": \"95bcd112-c138-4ca6-9df9-f4c508b9c0c1\"",
+		"\"key\": \"value\"",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Fatalf("expected %q in the decoded output:\n%s", expected, output.String())
+		}
+	}
+}
+
+func TestRunDecodeInvalidPacket(t *testing.T) {
+	var output bytes.Buffer
+	err := runDecode(strings.NewReader("DYLLABLE-INVALID\r\n\r\n"), &output)
+	if err == nil {
+		t.Fatal("decode should fail for an unknown packet")
+	}
+}
+
+func TestRunDiscoverSignedLobby(t *testing.T) {
+	discoverySocket := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8431}
+	appSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8432}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := network.DiscoveryConfig{Codec: network.NewSignedCodec([]byte("secret"))}
+	go network.DiscoveryService(ctx, make(chan *network.DiscoveredNode, 5), discoverySocket, appSocket, config)
+
+	//Give the Discovery Service time to bind its socket
+	time.Sleep(100 * time.Millisecond)
+
+	var output bytes.Buffer
+	err := runDiscover(ctx, []string{"-address", discoverySocket.String(), "-lobby-key", "secret", "-timeout", "300ms"}, &output)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.Contains(output.String(), appSocket.String()) {
+		t.Fatalf("expected %s in the discover output:\n%s", appSocket, output.String())
+	}
+}
@@ -0,0 +1,360 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// The magic byte can't start a text packet, so both formats can share a connection
+const binaryMagic byte = 0xDB
+
+const (
+	binaryDiscoveryType byte = iota + 1
+	binaryRequestActionType
+	binaryResponseActionType
+	binaryHeartbeatType
+)
+
+const (
+	binaryRequestDiscovery byte = iota + 1
+	binaryResponseDiscovery
+	binaryLeavingDiscovery
+)
+
+const (
+	binaryPingHeartbeat byte = iota + 1
+	binaryPongHeartbeat
+)
+
+// Flags following a discovery address, telling which optional fields come next.
+// Like the text headers, the details of a request are its query
+const (
+	binaryDiscoveryIdentity byte = 1 << iota
+	binaryDiscoveryDetails
+	binaryDiscoveryTimestamp
+)
+
+type discoveryDetails interface {
+	IsZero() bool
+	Validate() error
+}
+
+type binaryReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+var bodyDecoding, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+
+func MarshalBinaryPacket(packet Packet) (out []byte, err error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte(binaryMagic)
+	switch packet := packet.(type) {
+	case *DiscoveryPacket:
+		var discoveryType byte
+		switch packet.Type {
+		case requestDiscoveryType:
+			discoveryType = binaryRequestDiscovery
+		case responseDiscoveryType:
+			discoveryType = binaryResponseDiscovery
+		case leavingDiscoveryType:
+			discoveryType = binaryLeavingDiscovery
+		default:
+			return nil, fmt.Errorf("discovery type \"%s\" not supported", packet.Type)
+		}
+		address := packet.Address.To4()
+		if address == nil {
+			address = packet.Address.To16()
+		}
+		if address == nil {
+			return nil, fmt.Errorf("invalid discovery address %v", packet.Address)
+		}
+		buffer.Write([]byte{binaryDiscoveryType, packet.Version, packet.MinVersion, discoveryType, byte(len(address))})
+		buffer.Write(address)
+		binary.Write(&buffer, binary.BigEndian, packet.Port)
+		var flags byte
+		signed := packet.NodeID != nil && packet.Signature != nil
+		if signed {
+			if len(packet.NodeID) != ed25519.PublicKeySize || len(packet.Signature) != ed25519.SignatureSize {
+				return nil, errors.New("invalid NODE-ID or SIGNATURE length")
+			}
+			flags |= binaryDiscoveryIdentity
+		}
+		var details discoveryDetails = packet.Metadata
+		if packet.Type == requestDiscoveryType {
+			details = packet.Query
+		}
+		if !details.IsZero() {
+			err = details.Validate()
+			if err != nil {
+				return
+			}
+			flags |= binaryDiscoveryDetails
+		}
+		if !packet.Timestamp.IsZero() {
+			flags |= binaryDiscoveryTimestamp
+		}
+		buffer.WriteByte(flags)
+		if signed {
+			buffer.Write(packet.NodeID)
+			buffer.Write(packet.Signature)
+		}
+		if flags&binaryDiscoveryTimestamp != 0 {
+			binary.Write(&buffer, binary.BigEndian, packet.Timestamp.UnixNano())
+		}
+		if flags&binaryDiscoveryDetails != 0 {
+			var detailsBytes []byte
+			detailsBytes, err = cbor.Marshal(details)
+			if err != nil {
+				return
+			}
+			writeBinaryBytes(&buffer, detailsBytes)
+		}
+	case *RequestActionPacket:
+		buffer.Write([]byte{binaryRequestActionType, packet.Version})
+		buffer.Write(packet.RequestUUID[:])
+		buffer.WriteByte(packet.ActionId)
+		err = writeBinaryBody(&buffer, packet.Parameters)
+	case *ResponseActionPacket:
+		var approved byte
+		if packet.Approved {
+			approved = 1
+		}
+		buffer.Write([]byte{binaryResponseActionType, packet.Version})
+		buffer.Write(packet.RequestUUID[:])
+		buffer.WriteByte(approved)
+		err = writeBinaryBody(&buffer, packet.Content)
+	case *HeartbeatPacket:
+		var heartbeatType byte
+		switch packet.Type {
+		case pingHeartbeatType:
+			heartbeatType = binaryPingHeartbeat
+		case pongHeartbeatType:
+			heartbeatType = binaryPongHeartbeat
+		default:
+			return nil, fmt.Errorf("heartbeat type \"%s\" not supported", packet.Type)
+		}
+		buffer.Write([]byte{binaryHeartbeatType, packet.Version, heartbeatType})
+		binary.Write(&buffer, binary.BigEndian, packet.Sequence)
+		binary.Write(&buffer, binary.BigEndian, packet.Timestamp.UnixNano())
+	default:
+		return nil, fmt.Errorf("packet type %T not supported", packet)
+	}
+	if err != nil {
+		return
+	}
+	return buffer.Bytes(), nil
+}
+
+func ParseBinaryPacket(buffer *bytes.Buffer) (packet Packet, err error) {
+	packet, err = readBinaryPacket(buffer, DefaultPacketLimits)
+	return packet, truncatedPacket(err)
+}
+
+func readBinaryPacket(reader binaryReader, limits PacketLimits) (packet Packet, err error) {
+	limits = limits.orDefault()
+	magic, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	if magic != binaryMagic {
+		return nil, ErrUnknownIdentifier
+	}
+	packetHeader := make([]byte, 2)
+	_, err = io.ReadFull(reader, packetHeader)
+	if err != nil {
+		return nil, truncatedPacket(err)
+	}
+	packetType, packetVersion := packetHeader[0], packetHeader[1]
+	switch packetType {
+	case binaryDiscoveryType:
+		discoveryHeader := make([]byte, 3)
+		_, err = io.ReadFull(reader, discoveryHeader)
+		if err != nil {
+			return nil, truncatedPacket(err)
+		}
+		packetObj := DiscoveryPacket{Version: packetVersion, MinVersion: discoveryHeader[0]}
+		if packetObj.MinVersion > packetObj.Version {
+			return nil, fmt.Errorf("%w: minimum version %d is greater than version %d", ErrMalformedPacket, packetObj.MinVersion, packetObj.Version)
+		}
+		switch discoveryHeader[1] {
+		case binaryRequestDiscovery:
+			packetObj.Type = requestDiscoveryType
+		case binaryResponseDiscovery:
+			packetObj.Type = responseDiscoveryType
+		case binaryLeavingDiscovery:
+			packetObj.Type = leavingDiscoveryType
+		default:
+			return nil, fmt.Errorf("%w: discovery type %d not supported", ErrMalformedPacket, discoveryHeader[1])
+		}
+		addressLength := int(discoveryHeader[2])
+		if addressLength != net.IPv4len && addressLength != net.IPv6len {
+			return nil, fmt.Errorf("%w: invalid address length %d", ErrMalformedPacket, addressLength)
+		}
+		address := make([]byte, addressLength+3)
+		_, err = io.ReadFull(reader, address)
+		if err != nil {
+			return nil, truncatedPacket(err)
+		}
+		packetObj.Address = net.IP(address[:addressLength])
+		packetObj.Port = binary.BigEndian.Uint16(address[addressLength:])
+		flags := address[addressLength+2]
+		if flags&^(binaryDiscoveryIdentity|binaryDiscoveryDetails|binaryDiscoveryTimestamp) != 0 {
+			return nil, fmt.Errorf("%w: invalid discovery flags %d", ErrMalformedPacket, flags)
+		}
+		if flags&binaryDiscoveryIdentity != 0 {
+			identity := make([]byte, ed25519.PublicKeySize+ed25519.SignatureSize)
+			_, err = io.ReadFull(reader, identity)
+			if err != nil {
+				return nil, truncatedPacket(err)
+			}
+			packetObj.NodeID = ed25519.PublicKey(identity[:ed25519.PublicKeySize])
+			packetObj.Signature = identity[ed25519.PublicKeySize:]
+		}
+		if flags&binaryDiscoveryTimestamp != 0 {
+			timestamp := make([]byte, 8)
+			_, err = io.ReadFull(reader, timestamp)
+			if err != nil {
+				return nil, truncatedPacket(err)
+			}
+			packetObj.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(timestamp)))
+		}
+		if flags&binaryDiscoveryDetails != 0 {
+			var detailsBytes []byte
+			detailsBytes, err = readBinaryBytes(reader, limits.MaxHeaderLength*limits.MaxHeaderLines)
+			if err != nil {
+				return
+			}
+			if packetObj.Type == requestDiscoveryType {
+				err = cbor.Unmarshal(detailsBytes, &packetObj.Query)
+				if err == nil {
+					err = packetObj.Query.Validate()
+				}
+			} else {
+				err = cbor.Unmarshal(detailsBytes, &packetObj.Metadata)
+				if err == nil {
+					err = packetObj.Metadata.Validate()
+				}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid discovery details: %v", ErrMalformedPacket, err)
+			}
+		}
+		packet = &packetObj
+	case binaryRequestActionType:
+		packetObj := RequestActionPacket{Version: packetVersion}
+		actionHeader := make([]byte, len(packetObj.RequestUUID)+1)
+		_, err = io.ReadFull(reader, actionHeader)
+		if err != nil {
+			return nil, truncatedPacket(err)
+		}
+		copy(packetObj.RequestUUID[:], actionHeader)
+		packetObj.ActionId = actionHeader[len(packetObj.RequestUUID)]
+		packetObj.Parameters, err = readBinaryBody(reader, limits.MaxBodySize)
+		if err != nil {
+			return
+		}
+		packet = &packetObj
+	case binaryResponseActionType:
+		packetObj := ResponseActionPacket{Version: packetVersion}
+		actionHeader := make([]byte, len(packetObj.RequestUUID)+1)
+		_, err = io.ReadFull(reader, actionHeader)
+		if err != nil {
+			return nil, truncatedPacket(err)
+		}
+		copy(packetObj.RequestUUID[:], actionHeader)
+		switch actionHeader[len(packetObj.RequestUUID)] {
+		case 0:
+			packetObj.Approved = false
+		case 1:
+			packetObj.Approved = true
+		default:
+			return nil, fmt.Errorf("%w: invalid approved flag %d", ErrMalformedPacket, actionHeader[len(packetObj.RequestUUID)])
+		}
+		packetObj.Content, err = readBinaryBody(reader, limits.MaxBodySize)
+		if err != nil {
+			return
+		}
+		packet = &packetObj
+	case binaryHeartbeatType:
+		heartbeat := make([]byte, 17)
+		_, err = io.ReadFull(reader, heartbeat)
+		if err != nil {
+			return nil, truncatedPacket(err)
+		}
+		packetObj := HeartbeatPacket{Version: packetVersion}
+		switch heartbeat[0] {
+		case binaryPingHeartbeat:
+			packetObj.Type = pingHeartbeatType
+		case binaryPongHeartbeat:
+			packetObj.Type = pongHeartbeatType
+		default:
+			return nil, fmt.Errorf("%w: heartbeat type %d not supported", ErrMalformedPacket, heartbeat[0])
+		}
+		packetObj.Sequence = binary.BigEndian.Uint64(heartbeat[1:])
+		packetObj.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(heartbeat[9:])))
+		packet = &packetObj
+	default:
+		err = ErrUnknownIdentifier
+	}
+	return
+}
+
+func writeBinaryBody(buffer *bytes.Buffer, body map[string]interface{}) error {
+	var bodyBytes []byte
+	if body != nil {
+		var err error
+		bodyBytes, err = cbor.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	writeBinaryBytes(buffer, bodyBytes)
+	return nil
+}
+
+func writeBinaryBytes(buffer *bytes.Buffer, value []byte) {
+	length := make([]byte, binary.MaxVarintLen64)
+	buffer.Write(length[:binary.PutUvarint(length, uint64(len(value)))])
+	buffer.Write(value)
+}
+
+func readBinaryBody(reader binaryReader, maxBodySize int) (body map[string]interface{}, err error) {
+	bodyBytes, err := readBinaryBytes(reader, maxBodySize)
+	if err != nil || bodyBytes == nil {
+		return
+	}
+	err = bodyDecoding.Unmarshal(bodyBytes, &body)
+	if err != nil {
+		return nil, &InvalidBodyError{err}
+	}
+	return
+}
+
+func readBinaryBytes(reader binaryReader, maxSize int) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, truncatedPacket(err)
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	if length > uint64(maxSize) {
+		return nil, ErrBodyTooLarge
+	}
+	var valueBuffer bytes.Buffer
+	_, err = io.CopyN(&valueBuffer, reader, int64(length))
+	if err != nil {
+		return nil, truncatedPacket(err)
+	}
+	return valueBuffer.Bytes(), nil
+}
@@ -0,0 +1,165 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestBinaryPacketRoundTrip(t *testing.T) {
+	discoveryPacket := NewRequestDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8400)
+	ipv6DiscoveryPacket := NewResponseDiscoveryPacket(net.ParseIP("fe80::1"), 8401)
+	ipv6DiscoveryPacket.Metadata = DiscoveryMetadata{Name: "host", Game: "coop", MaxPlayers: 4}
+	requestPacket := NewRequestActionPacket(1, map[string]interface{}{"key": "value", "key2": 10.5, "key3": true})
+	emptyRequestPacket := NewRequestActionPacket(2, nil)
+	responsePacket := NewResponseActionPacket(uuid.New(), true, map[string]interface{}{"nested": map[string]interface{}{"key": "value"}})
+	emptyResponsePacket := NewResponseActionPacket(uuid.New(), false, nil)
+	packets := []Packet{&discoveryPacket, &ipv6DiscoveryPacket, &requestPacket, &emptyRequestPacket, &responsePacket, &emptyResponsePacket}
+
+	for i, expected := range packets {
+		packetBytes, err := MarshalBinaryPacket(expected)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if packetBytes[0] != binaryMagic {
+			t.Fatalf("%d: expected binary packet to start with the magic byte instead of %x", i, packetBytes[0])
+		}
+		packet, err := ParseBinaryPacket(bytes.NewBuffer(packetBytes))
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if discovery, ok := packet.(*DiscoveryPacket); ok {
+			if !discovery.Address.Equal(expected.(*DiscoveryPacket).Address) {
+				t.Fatalf("%d: expected address %v instead of %v", i, expected.(*DiscoveryPacket).Address, discovery.Address)
+			}
+			discovery.Address = expected.(*DiscoveryPacket).Address
+		}
+		if !reflect.DeepEqual(packet, expected) {
+			t.Fatalf("%d: expected parsed packet %#v instead of %#v", i, expected, packet)
+		}
+	}
+}
+
+func TestBinaryPacketIsSmaller(t *testing.T) {
+	requestPacket := NewRequestActionPacket(1, map[string]interface{}{"x": 10.0, "y": 20.0})
+	textBytes, _ := requestPacket.Bytes()
+	binaryBytes, err := MarshalBinaryPacket(&requestPacket)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(binaryBytes) >= len(textBytes)/2 {
+		t.Fatalf("expected binary packet (%d bytes) to be much smaller than text packet (%d bytes)", len(binaryBytes), len(textBytes))
+	}
+}
+
+func TestParseInvalidBinaryPacket(t *testing.T) {
+	requestPacket := NewRequestActionPacket(1, map[string]interface{}{"key": "value"})
+	packetBytes, _ := MarshalBinaryPacket(&requestPacket)
+
+	for length := 1; length < len(packetBytes); length++ {
+		_, err := ParseBinaryPacket(bytes.NewBuffer(packetBytes[:length]))
+		if err != ErrTruncatedPacket {
+			t.Fatalf("expected ErrTruncatedPacket for %d bytes instead of %v", length, err)
+		}
+	}
+
+	invalidPackets := map[string][]byte{
+		"magic":   {0x00, binaryRequestActionType, ProtocolVersion},
+		"type":    {binaryMagic, 0xFF, ProtocolVersion},
+		"address": {binaryMagic, binaryDiscoveryType, 1, 1, binaryRequestDiscovery, 5, 0, 0, 0, 0, 0, 0, 0},
+		"version": {binaryMagic, binaryDiscoveryType, 1, 2, binaryRequestDiscovery, 4, 127, 0, 0, 1, 0x20, 0xD0},
+	}
+	for name, invalidBytes := range invalidPackets {
+		_, err := ParseBinaryPacket(bytes.NewBuffer(invalidBytes))
+		if !errors.Is(err, ErrMalformedPacket) {
+			t.Fatalf("%s: expected ErrMalformedPacket instead of %v", name, err)
+		}
+	}
+
+	invalidBody := append([]byte{}, packetBytes[:len(packetBytes)-len("value")-1]...)
+	invalidBody = append(invalidBody, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	_, err := ParseBinaryPacket(bytes.NewBuffer(invalidBody))
+	var bodyErr *InvalidBodyError
+	if !errors.As(err, &bodyErr) {
+		t.Fatalf("expected InvalidBodyError instead of %v", err)
+	}
+}
+
+func TestPacketDecoderMixedCodecs(t *testing.T) {
+	packets, _ := encodeTestPackets(t)
+	var stream bytes.Buffer
+	encoder := NewPacketEncoder(&stream)
+	codecs := []Codec{}
+	for i, packet := range packets {
+		codec := []Codec{TextCodec{}, BinaryCodec{}}[i%2]
+		encoder.SetCodec(codec)
+		err := encoder.Encode(packet)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		codecs = append(codecs, codec)
+	}
+
+	decoder := NewPacketDecoder(&chunkReader{stream.Bytes(), 1})
+	for i, expected := range packets {
+		packet, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if decoder.Codec() != codecs[i] {
+			t.Fatalf("%d: expected %T instead of %T", i, codecs[i], decoder.Codec())
+		}
+		if discovery, ok := packet.(*DiscoveryPacket); ok {
+			discovery.Address = expected.(*DiscoveryPacket).Address
+		}
+		if !reflect.DeepEqual(packet, expected) {
+			t.Fatalf("%d: expected decoded packet %#v instead of %#v", i, expected, packet)
+		}
+	}
+}
+
+func TestActionClientBinaryCodec(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	router := NewActionRouter()
+	router.Handle(1, echoHandler)
+	go router.ServeConn(context.Background(), server)
+
+	var sniffer bytes.Buffer
+	actionClient := NewActionClient(io.MultiWriter(client, &sniffer), time.Second)
+	actionClient.SetCodec(BinaryCodec{})
+	go actionClient.Serve(client)
+
+	response, err := actionClient.Call(context.Background(), 1, map[string]interface{}{"key": "value"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !response.Approved || response.Content["key"] != "value" {
+		t.Fatalf("unexpected response %v", response.Content)
+	}
+	if sniffer.Bytes()[0] != binaryMagic {
+		t.Fatal("expected the request to be sent with the binary codec")
+	}
+}
+
+func TestBinaryCodecLimits(t *testing.T) {
+	requestPacket := NewRequestActionPacket(1, map[string]interface{}{"key": "a long enough value"})
+	packetBytes, _ := MarshalBinaryPacket(&requestPacket)
+	_, err := BinaryCodec{Limits: PacketLimits{MaxBodySize: 8}}.Decode(bytes.NewReader(packetBytes))
+	if err != ErrBodyTooLarge {
+		t.Fatalf("expected ErrBodyTooLarge instead of %v", err)
+	}
+	_, err = BinaryCodec{}.Decode(bytes.NewReader(packetBytes))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
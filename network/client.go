@@ -0,0 +1,229 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrUnsolicitedResponse = errors.New("unsolicited response: request UUID is not in flight")
+var ErrDuplicateRequest = errors.New("request UUID is already in flight")
+var ErrClientClosed = errors.New("action client is closed")
+
+type ActionClient struct {
+	encoder    *PacketEncoder
+	timeout    time.Duration
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	inFlight   map[uuid.UUID]chan *ResponseActionPacket
+	sequence   uint64
+	pings      map[uint64]chan *HeartbeatPacket
+	closed     chan struct{}
+	err        error
+}
+
+func NewActionClient(writer io.Writer, timeout time.Duration) *ActionClient {
+	return &ActionClient{
+		encoder:  NewPacketEncoder(writer),
+		timeout:  timeout,
+		inFlight: make(map[uuid.UUID]chan *ResponseActionPacket),
+		pings:    make(map[uint64]chan *HeartbeatPacket),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (client *ActionClient) SetCodec(codec Codec) {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+	client.encoder.SetCodec(codec)
+}
+
+func (client *ActionClient) Call(ctx context.Context, actionId uint8, parameters map[string]interface{}) (*ResponseActionPacket, error) {
+	request := NewRequestActionPacket(actionId, parameters)
+	return client.Send(ctx, &request)
+}
+
+func (client *ActionClient) Send(ctx context.Context, request *RequestActionPacket) (response *ResponseActionPacket, err error) {
+	if client.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.timeout)
+		defer cancel()
+	}
+	responseChannel, err := client.register(request.RequestUUID)
+	if err != nil {
+		return
+	}
+	defer client.unregister(request.RequestUUID)
+
+	err = client.write(request)
+	if err != nil {
+		return
+	}
+
+	select {
+	case response = <-responseChannel:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-client.closed:
+		err = client.err
+	}
+	return
+}
+
+// Sends a PING and waits for its PONG, returning the round trip time
+func (client *ActionClient) Ping(ctx context.Context) (rtt time.Duration, err error) {
+	client.mutex.Lock()
+	select {
+	case <-client.closed:
+		client.mutex.Unlock()
+		return 0, client.err
+	default:
+	}
+	client.sequence++
+	ping := NewPingPacket(client.sequence)
+	pongChannel := make(chan *HeartbeatPacket, 1)
+	client.pings[ping.Sequence] = pongChannel
+	client.mutex.Unlock()
+	defer func() {
+		client.mutex.Lock()
+		delete(client.pings, ping.Sequence)
+		client.mutex.Unlock()
+	}()
+
+	start := time.Now()
+	err = client.write(&ping)
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-pongChannel:
+		rtt = time.Since(start)
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-client.closed:
+		err = client.err
+	}
+	return
+}
+
+func (client *ActionClient) Resolve(response *ResponseActionPacket) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	responseChannel, ok := client.inFlight[response.RequestUUID]
+	if !ok {
+		return ErrUnsolicitedResponse
+	}
+	delete(client.inFlight, response.RequestUUID)
+	responseChannel <- response
+	return nil
+}
+
+func (client *ActionClient) Serve(reader io.Reader) (err error) {
+	client.writeMutex.Lock()
+	codec := client.encoder.Codec()
+	client.writeMutex.Unlock()
+	decoder := NewPacketDecoder(reader)
+	decoder.SetCodec(codec)
+	for {
+		var packet Packet
+		packet, err = decoder.Decode()
+		if err != nil {
+			break
+		}
+		switch packet := packet.(type) {
+		case *ResponseActionPacket:
+			client.Resolve(packet)
+		case *HeartbeatPacket:
+			client.resolvePong(packet)
+		}
+	}
+	client.Close(err)
+	return
+}
+
+func (client *ActionClient) Close(err error) {
+	if err == nil || err == io.EOF {
+		err = ErrClientClosed
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	select {
+	case <-client.closed:
+		return
+	default:
+	}
+	client.err = err
+	close(client.closed)
+}
+
+// Whether the connection of the client was closed or broken
+func (client *ActionClient) isClosed() bool {
+	select {
+	case <-client.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// A packet that failed to be written may have been left halfway on the
+// stream, so the client is closed. One that failed to be encoded was never sent
+func (client *ActionClient) write(packet Packet) error {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+	packetBytes, err := client.encoder.Codec().Encode(packet)
+	if err != nil {
+		return err
+	}
+	_, err = client.encoder.writer.Write(packetBytes)
+	if err != nil {
+		client.Close(err)
+	}
+	return err
+}
+
+func (client *ActionClient) InFlight() int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return len(client.inFlight)
+}
+
+func (client *ActionClient) resolvePong(pong *HeartbeatPacket) {
+	if pong.Type != pongHeartbeatType {
+		return
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	pongChannel, ok := client.pings[pong.Sequence]
+	if ok {
+		delete(client.pings, pong.Sequence)
+		pongChannel <- pong
+	}
+}
+
+func (client *ActionClient) register(requestUUID uuid.UUID) (chan *ResponseActionPacket, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	select {
+	case <-client.closed:
+		return nil, client.err
+	default:
+	}
+	if _, ok := client.inFlight[requestUUID]; ok {
+		return nil, ErrDuplicateRequest
+	}
+	responseChannel := make(chan *ResponseActionPacket, 1)
+	client.inFlight[requestUUID] = responseChannel
+	return responseChannel, nil
+}
+
+func (client *ActionClient) unregister(requestUUID uuid.UUID) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	delete(client.inFlight, requestUUID)
+}
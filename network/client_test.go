@@ -0,0 +1,183 @@
+package network
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func startActionClient(t *testing.T, timeout time.Duration) (*ActionClient, net.Conn) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	client := NewActionClient(clientConn, timeout)
+	go client.Serve(clientConn)
+	return client, serverConn
+}
+
+func readRequestActionPacket(t *testing.T, decoder *PacketDecoder) *RequestActionPacket {
+	packet, err := decoder.Decode()
+	if err != nil {
+		t.Errorf("%v", err)
+		return nil
+	}
+	request, ok := packet.(*RequestActionPacket)
+	if !ok {
+		t.Errorf("expected RequestActionPacket object instead of %T", packet)
+	}
+	return request
+}
+
+func TestActionClientCall(t *testing.T) {
+	client, serverConn := startActionClient(t, time.Second)
+
+	go func() {
+		decoder := NewPacketDecoder(serverConn)
+		encoder := NewPacketEncoder(serverConn)
+		request := readRequestActionPacket(t, decoder)
+		if request == nil {
+			return
+		}
+		content := map[string]interface{}{"action": float64(request.ActionId), "echo": request.Parameters["key"]}
+		response := NewResponseActionPacket(request.RequestUUID, true, content)
+		encoder.Encode(&response)
+	}()
+
+	response, err := client.Call(context.Background(), 7, map[string]interface{}{"key": "value"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !response.Approved {
+		t.Fatalf("expected an approved response")
+	}
+	if response.Content["action"] != 7.0 || response.Content["echo"] != "value" {
+		t.Fatalf("unexpected response content %v", response.Content)
+	}
+	if client.InFlight() != 0 {
+		t.Fatalf("expected no requests in flight after the response instead of %d", client.InFlight())
+	}
+}
+
+func TestActionClientConcurrentCalls(t *testing.T) {
+	client, serverConn := startActionClient(t, time.Second)
+
+	go func() {
+		decoder := NewPacketDecoder(serverConn)
+		encoder := NewPacketEncoder(serverConn)
+		var requests []*RequestActionPacket
+		for i := 0; i < 2; i++ {
+			request := readRequestActionPacket(t, decoder)
+			if request == nil {
+				return
+			}
+			requests = append(requests, request)
+		}
+		//Answer in the reverse order
+		for i := len(requests) - 1; i >= 0; i-- {
+			content := map[string]interface{}{"action": float64(requests[i].ActionId)}
+			response := NewResponseActionPacket(requests[i].RequestUUID, true, content)
+			encoder.Encode(&response)
+		}
+	}()
+
+	results := make(chan error, 2)
+	for _, actionId := range []uint8{1, 2} {
+		go func(actionId uint8) {
+			response, err := client.Call(context.Background(), actionId, nil)
+			if err == nil && response.Content["action"] != float64(actionId) {
+				t.Errorf("response for action %d was delivered to the wrong call: %v", actionId, response.Content)
+			}
+			results <- err
+		}(actionId)
+	}
+	for i := 0; i < 2; i++ {
+		err := <-results
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+}
+
+func TestActionClientTimeout(t *testing.T) {
+	client, serverConn := startActionClient(t, 100*time.Millisecond)
+	go io.Copy(io.Discard, serverConn)
+
+	_, err := client.Call(context.Background(), 1, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded instead of %v", err)
+	}
+	if client.InFlight() != 0 {
+		t.Fatalf("timed out request should not be in flight")
+	}
+}
+
+func TestActionClientContextCancel(t *testing.T) {
+	client, serverConn := startActionClient(t, 0)
+	go io.Copy(io.Discard, serverConn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err := client.Call(ctx, 1, nil)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled instead of %v", err)
+	}
+}
+
+func TestActionClientRejectsUnexpectedResponses(t *testing.T) {
+	client := NewActionClient(io.Discard, time.Second)
+
+	unsolicited := NewResponseActionPacket(uuid.New(), true, nil)
+	if err := client.Resolve(&unsolicited); err != ErrUnsolicitedResponse {
+		t.Fatalf("expected ErrUnsolicitedResponse instead of %v", err)
+	}
+
+	request := NewRequestActionPacket(1, nil)
+	result := make(chan *ResponseActionPacket, 1)
+	go func() {
+		response, _ := client.Send(context.Background(), &request)
+		result <- response
+	}()
+	for client.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := client.Send(context.Background(), &request); err != ErrDuplicateRequest {
+		t.Fatalf("expected ErrDuplicateRequest instead of %v", err)
+	}
+
+	response := NewResponseActionPacket(request.RequestUUID, true, nil)
+	if err := client.Resolve(&response); err != nil {
+		t.Fatalf("%v", err)
+	}
+	duplicate := NewResponseActionPacket(request.RequestUUID, false, nil)
+	if err := client.Resolve(&duplicate); err != ErrUnsolicitedResponse {
+		t.Fatalf("expected duplicate response to be rejected instead of %v", err)
+	}
+	if received := <-result; received == nil || !received.Approved {
+		t.Fatalf("expected the first response to be delivered instead of %v", received)
+	}
+}
+
+func TestActionClientConnectionClosed(t *testing.T) {
+	client, serverConn := startActionClient(t, time.Second)
+
+	go func() {
+		readRequestActionPacket(t, NewPacketDecoder(serverConn))
+		serverConn.Close()
+	}()
+
+	_, err := client.Call(context.Background(), 1, nil)
+	if err != ErrClientClosed {
+		t.Fatalf("expected ErrClientClosed instead of %v", err)
+	}
+	_, err = client.Call(context.Background(), 1, nil)
+	if err != ErrClientClosed {
+		t.Fatalf("expected ErrClientClosed for calls after the connection is closed instead of %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+type Codec interface {
+	Encode(packet Packet) ([]byte, error)
+	Decode(reader io.Reader) (Packet, error)
+}
+
+type TextCodec struct {
+	Limits PacketLimits
+}
+
+type BinaryCodec struct {
+	Limits PacketLimits
+}
+
+var DefaultCodec Codec = TextCodec{}
+
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "text":
+		return TextCodec{}, nil
+	case "binary":
+		return BinaryCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown codec \"%s\"", name)
+}
+
+func (codec TextCodec) Encode(packet Packet) ([]byte, error) {
+	return packet.Bytes()
+}
+
+func (codec TextCodec) Decode(reader io.Reader) (packet Packet, err error) {
+	if buffer, ok := reader.(*bytes.Buffer); ok {
+		return ParsePacketWithLimits(buffer, codec.Limits)
+	}
+	frame, err := readTextFrame(bufferedReader(reader), codec.Limits)
+	if err != nil {
+		return
+	}
+	return ParsePacketWithLimits(bytes.NewBuffer(frame), codec.Limits)
+}
+
+func (codec BinaryCodec) Encode(packet Packet) ([]byte, error) {
+	return MarshalBinaryPacket(packet)
+}
+
+func (codec BinaryCodec) Decode(reader io.Reader) (Packet, error) {
+	if reader, ok := reader.(binaryReader); ok {
+		return readBinaryPacket(reader, codec.Limits)
+	}
+	return readBinaryPacket(bufferedReader(reader), codec.Limits)
+}
+
+// The text and binary codecs can be told apart by the first byte, so a peer
+// using either of them is answered with the codec it has chosen
+func detectCodec(codec Codec, reader *bufio.Reader) (Codec, error) {
+	var limits PacketLimits
+	switch codec := codec.(type) {
+	case TextCodec:
+		limits = codec.Limits
+	case BinaryCodec:
+		limits = codec.Limits
+	default:
+		return codec, nil
+	}
+	magic, err := reader.Peek(1)
+	if err != nil {
+		return codec, err
+	}
+	if magic[0] == binaryMagic {
+		return BinaryCodec{limits}, nil
+	}
+	return TextCodec{limits}, nil
+}
+
+func decodeDatagram(codec Codec, datagram []byte) (packet Packet, replyCodec Codec, err error) {
+	reader := bufio.NewReader(bytes.NewReader(datagram))
+	replyCodec, err = detectCodec(codec, reader)
+	if err != nil {
+		return
+	}
+	packet, err = replyCodec.Decode(reader)
+	return
+}
+
+// Wrapping a reader that isn't buffered may consume bytes past the decoded
+// packet, so streams should be decoded through a PacketDecoder
+func bufferedReader(reader io.Reader) *bufio.Reader {
+	if buffered, ok := reader.(*bufio.Reader); ok {
+		return buffered
+	}
+	return bufio.NewReaderSize(reader, bufferSize)
+}
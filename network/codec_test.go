@@ -0,0 +1,172 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Prefixes each text packet with its length, standing for any codec defined outside the package
+type framedCodec struct{}
+
+func (codec framedCodec) Encode(packet Packet) ([]byte, error) {
+	packetBytes, err := packet.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 4, 4+len(packetBytes))
+	binary.BigEndian.PutUint32(frame, uint32(len(packetBytes)))
+	return append(frame, packetBytes...), nil
+}
+
+func (codec framedCodec) Decode(reader io.Reader) (Packet, error) {
+	length := make([]byte, 4)
+	_, err := io.ReadFull(reader, length)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(length))
+	_, err = io.ReadFull(reader, frame)
+	if err != nil {
+		return nil, truncatedPacket(err)
+	}
+	return ParsePacket(bytes.NewBuffer(frame))
+}
+
+func TestCodecs(t *testing.T) {
+	packets, _ := encodeTestPackets(t)
+	for _, name := range []string{"text", "binary"} {
+		codec, err := ParseCodec(name)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		for i, expected := range packets {
+			packetBytes, err := codec.Encode(expected)
+			if err != nil {
+				t.Fatalf("%s %d: %v", name, i, err)
+			}
+			packet, err := codec.Decode(bytes.NewReader(packetBytes))
+			if err != nil {
+				t.Fatalf("%s %d: %v", name, i, err)
+			}
+			if discovery, ok := packet.(*DiscoveryPacket); ok {
+				discovery.Address = expected.(*DiscoveryPacket).Address
+			}
+			if !reflect.DeepEqual(packet, expected) {
+				t.Fatalf("%s %d: expected decoded packet %#v instead of %#v", name, i, expected, packet)
+			}
+		}
+	}
+	_, err := ParseCodec("yaml")
+	if err == nil {
+		t.Fatal("unknown codec name should not be parsed")
+	}
+}
+
+func TestCodecsDecodeBufferedPackets(t *testing.T) {
+	packets, _ := encodeTestPackets(t)
+	legacyRequest := "DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: 95bcd112-c138-4ca6-9df9-f4c508b9c0c1\r\n" +
+		"ACTION-ID: 1\r\n" +
+		"\r\n"
+	for _, name := range []string{"text", "binary"} {
+		codec, _ := ParseCodec(name)
+		var buffer bytes.Buffer
+		for _, packet := range packets {
+			packetBytes, err := codec.Encode(packet)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			buffer.Write(packetBytes)
+		}
+		if name == "text" {
+			buffer.WriteString(legacyRequest + "{\"key\": \"value\"}\r\n\r\n" + legacyRequest)
+		}
+		for i := range packets {
+			_, err := codec.Decode(&buffer)
+			if err != nil {
+				t.Fatalf("%s %d: %v", name, i, err)
+			}
+		}
+		if name == "text" {
+			packet, err := codec.Decode(&buffer)
+			if err != nil || packet.(*RequestActionPacket).Parameters["key"] != "value" {
+				t.Fatalf("expected the legacy request with its body instead of %v %v", packet, err)
+			}
+			packet, err = codec.Decode(&buffer)
+			if err != nil || packet.(*RequestActionPacket).Parameters != nil {
+				t.Fatalf("expected the legacy request without body instead of %v %v", packet, err)
+			}
+		}
+		if buffer.Len() != 0 {
+			t.Fatalf("%s: expected every packet to be consumed, %q is left", name, buffer.String())
+		}
+	}
+}
+
+func TestActionRouterCustomCodec(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	router := NewActionRouter()
+	router.SetCodec(framedCodec{})
+	router.Handle(1, echoHandler)
+	go router.ServeConn(context.Background(), server)
+
+	actionClient := NewActionClient(client, time.Second)
+	actionClient.SetCodec(framedCodec{})
+	go actionClient.Serve(client)
+
+	for i := 0; i < 3; i++ {
+		response, err := actionClient.Call(context.Background(), 1, map[string]interface{}{"index": float64(i)})
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !response.Approved || response.Content["index"] != float64(i) {
+			t.Fatalf("%d: unexpected response %v", i, response.Content)
+		}
+	}
+}
+
+func TestDiscoveryCustomCodec(t *testing.T) {
+	serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lookupConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	serviceSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8412}
+	lookupSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8413}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serviceNodes := make(chan *DiscoveredNode, 1)
+	lookupNodes := make(chan *DiscoveredNode, 1)
+	go serveDiscovery(ctx, serviceConn, DiscoveryConfig{Codec: framedCodec{}}, serviceNodes, serviceSocket)
+	go lookForNodes(ctx, lookupConn, DiscoveryConfig{Codec: framedCodec{}}, lookupNodes, serviceConn.LocalAddr().(*net.UDPAddr), lookupSocket, nil)
+
+	select {
+	case node := <-lookupNodes:
+		if node.Address.String() != serviceSocket.String() {
+			t.Fatalf("expected %s to be discovered instead of %s", serviceSocket, node)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("discovery response was not decoded with the custom codec")
+	}
+	select {
+	case node := <-serviceNodes:
+		if node.Address.String() != lookupSocket.String() {
+			t.Fatalf("expected %s to be discovered instead of %s", lookupSocket, node)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("discovery request was not decoded with the custom codec")
+	}
+}
@@ -1,39 +1,303 @@
 package network
 
 import (
-	"bytes"
 	"context"
-	"fmt"
+	"crypto/ed25519"
+	"errors"
+	"math/rand"
 	"net"
+	"strconv"
+	"sync"
 	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
-const bufferSize = 1024
-const writingSocketTimeout = 5 * time.Second
-const lookForNodesInterval = 30 * time.Second
+const bufferSize = 4096
+const maxLeavingRecipients = 256
+const maxReplySources = 1024
+
+type MulticastConfig struct {
+	Interface *net.Interface
+	TTL       int
+	Loopback  bool
+}
+
+type DiscoveryConfig struct {
+	ProbeInterval time.Duration
+	//Fraction of the interval randomly added or removed, so nodes started together don't probe together
+	ProbeJitter float64
+	//Requests sent BurstInterval apart once the first one is out, so nodes are found before the first interval
+	BurstProbes    int
+	BurstInterval  time.Duration
+	ReadBufferSize int
+	WriteTimeout   time.Duration
+	//Shortest time between two replies to the same source
+	ReplyInterval time.Duration
+	//When set, the discovery address is a group joined on the interface it selects
+	Multicast *MulticastConfig
+	//Names of the interfaces discovery runs on, every interface that is up when empty
+	Interfaces []string
+	Codec      Codec
+	Identity   ed25519.PrivateKey
+	Metadata   func() DiscoveryMetadata
+	Query      DiscoveryQuery
+	//Called with the nodes dropped because no protocol version is supported by both sides
+	Incompatible func(node *DiscoveredNode, err error)
+}
+
+// Jitter is a fraction of a delay, so it stays under 1 to keep every delay positive
+const maxJitter = 0.9
+
+var DefaultDiscoveryConfig = DiscoveryConfig{
+	ProbeInterval:  30 * time.Second,
+	ProbeJitter:    0.1,
+	BurstProbes:    2,
+	BurstInterval:  250 * time.Millisecond,
+	ReadBufferSize: bufferSize,
+	WriteTimeout:   5 * time.Second,
+	ReplyInterval:  100 * time.Millisecond,
+	Codec:          DefaultCodec,
+}
+
+type multicastConn interface {
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	SetMulticastInterface(ifi *net.Interface) error
+	SetMulticastLoopback(on bool) error
+	SetMulticastHops(hops int) error
+}
+
+type leavingRecipient struct {
+	addr  net.Addr
+	codec Codec
+	host  net.IP
+}
+
+// Remembers when each source was last answered, so a flood of requests cannot be amplified
+type replyLimiter struct {
+	interval time.Duration
+	replied  map[string]time.Time
+}
+
+type ipv4MulticastConn struct {
+	*ipv4.PacketConn
+}
+
+type ipv6MulticastConn struct {
+	*ipv6.PacketConn
+}
+
+func (conn ipv4MulticastConn) SetMulticastHops(hops int) error {
+	return conn.SetMulticastTTL(hops)
+}
+
+func (conn ipv6MulticastConn) SetMulticastHops(hops int) error {
+	return conn.SetMulticastHopLimit(hops)
+}
+
+// Zero fields fall back to DefaultDiscoveryConfig, negative BurstProbes and ProbeJitter turn them off.
+// A ProbeJitter of 1 or more is capped at maxJitter
+func (config DiscoveryConfig) orDefault() DiscoveryConfig {
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = DefaultDiscoveryConfig.ProbeInterval
+	}
+	if config.ProbeJitter == 0 {
+		config.ProbeJitter = DefaultDiscoveryConfig.ProbeJitter
+	}
+	if config.ProbeJitter > maxJitter {
+		config.ProbeJitter = maxJitter
+	}
+	if config.BurstProbes == 0 {
+		config.BurstProbes = DefaultDiscoveryConfig.BurstProbes
+	}
+	if config.BurstInterval <= 0 {
+		config.BurstInterval = DefaultDiscoveryConfig.BurstInterval
+	}
+	if config.ReadBufferSize <= 0 {
+		config.ReadBufferSize = DefaultDiscoveryConfig.ReadBufferSize
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = DefaultDiscoveryConfig.WriteTimeout
+	}
+	if config.ReplyInterval <= 0 {
+		config.ReplyInterval = DefaultDiscoveryConfig.ReplyInterval
+	}
+	if config.Codec == nil {
+		config.Codec = DefaultDiscoveryConfig.Codec
+	}
+	return config
+}
+
+// Delay before the next DISCOVERY request once sent requests are out
+func (config DiscoveryConfig) probeDelay(sent int) time.Duration {
+	if sent <= config.BurstProbes {
+		return config.BurstInterval
+	}
+	delay := float64(config.ProbeInterval)
+	if config.ProbeJitter > 0 {
+		delay *= 1 + config.ProbeJitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+func (config DiscoveryConfig) metadata() DiscoveryMetadata {
+	if config.Metadata == nil {
+		return DiscoveryMetadata{}
+	}
+	return config.Metadata()
+}
+
+func (config DiscoveryConfig) reportIncompatible(discoveryPacket *DiscoveryPacket, err error) {
+	var versionErr *IncompatibleVersionError
+	if config.Incompatible == nil || !errors.As(err, &versionErr) || discoveryPacket.Address.IsUnspecified() {
+		return
+	}
+	address := &net.TCPAddr{IP: discoveryPacket.Address, Port: int(discoveryPacket.Port)}
+	config.Incompatible(&DiscoveredNode{Address: address, NodeID: discoveryPacket.NodeID, Metadata: discoveryPacket.Metadata}, err)
+}
+
+func DiscoveryService(ctx context.Context, discoveredNodes chan *DiscoveredNode, discoverySocket *net.UDPAddr, appSocket *net.TCPAddr, config DiscoveryConfig) (err error) {
+	conn, err := listenDiscovery(discoverySocket, config)
+	if err != nil {
+		return
+	}
+	return serveDiscovery(ctx, conn, config, discoveredNodes, appSocket)
+}
+
+func MulticastDiscoveryService(ctx context.Context, discoveredNodes chan *DiscoveredNode, multicastGroup *net.UDPAddr, appSocket *net.TCPAddr, config MulticastConfig) (err error) {
+	return DiscoveryService(ctx, discoveredNodes, multicastGroup, appSocket, DiscoveryConfig{Multicast: &config})
+}
+
+func LookForNodes(ctx context.Context, discoveredNodes chan *DiscoveredNode, dstAddress *net.UDPAddr, appSocket *net.TCPAddr, config DiscoveryConfig) (err error) {
+	err = config.Query.Validate()
+	if err != nil {
+		return
+	}
+	conn, err := dialDiscovery(dstAddress, config)
+	if err != nil {
+		return
+	}
+	return lookForNodes(ctx, conn, config, discoveredNodes, dstAddress, appSocket, nil)
+}
+
+func MulticastLookForNodes(ctx context.Context, discoveredNodes chan *DiscoveredNode, multicastGroup *net.UDPAddr, appSocket *net.TCPAddr, config MulticastConfig) (err error) {
+	return LookForNodes(ctx, discoveredNodes, multicastGroup, appSocket, DiscoveryConfig{Multicast: &config})
+}
+
+func listenDiscovery(discoverySocket *net.UDPAddr, config DiscoveryConfig) (*net.UDPConn, error) {
+	if config.Multicast != nil {
+		return listenMulticastGroup(discoverySocket, *config.Multicast, config.Interfaces)
+	}
+	return net.ListenUDP(udpNetwork(discoverySocket.IP), discoverySocket)
+}
+
+func dialDiscovery(dstAddress *net.UDPAddr, config DiscoveryConfig) (*net.UDPConn, error) {
+	if config.Multicast != nil {
+		return dialMulticastGroup(dstAddress, *config.Multicast)
+	}
+	return net.ListenUDP(udpNetwork(dstAddress.IP), nil)
+}
 
-func DiscoveryService(ctx context.Context, discoveredNodes chan *net.TCPAddr, discoverySocket *net.UDPAddr, appSocket *net.TCPAddr) (err error) {
-	conn, err := net.ListenUDP("udp4", discoverySocket)
+// The group is joined on each named interface, or on the configured one when there are no names
+func listenMulticastGroup(multicastGroup *net.UDPAddr, config MulticastConfig, ifaceNames []string) (conn *net.UDPConn, err error) {
+	//Binding to the group address lets several nodes share the port on the same host
+	conn, err = net.ListenUDP(udpNetwork(multicastGroup.IP), multicastGroup)
 	if err != nil {
 		return
 	}
-	defer conn.Close()
-	defer close(discoveredNodes)
+	packetConn := newMulticastConn(conn, multicastGroup)
+	if len(ifaceNames) == 0 {
+		err = packetConn.JoinGroup(config.Interface, multicastGroup)
+	}
+	for _, name := range ifaceNames {
+		var iface *net.Interface
+		iface, err = net.InterfaceByName(name)
+		if err == nil {
+			err = packetConn.JoinGroup(iface, multicastGroup)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = setMulticastOptions(packetConn, config)
+	}
+	if err != nil {
+		conn.Close()
+	}
+	return
+}
+
+func dialMulticastGroup(multicastGroup *net.UDPAddr, config MulticastConfig) (conn *net.UDPConn, err error) {
+	conn, err = net.ListenUDP(udpNetwork(multicastGroup.IP), nil)
+	if err != nil {
+		return
+	}
+	err = setMulticastOptions(newMulticastConn(conn, multicastGroup), config)
+	if err != nil {
+		conn.Close()
+	}
+	return
+}
+
+func udpNetwork(ip net.IP) string {
+	switch {
+	case ip == nil || ip.Equal(net.IPv6unspecified):
+		return "udp"
+	case ip.To4() != nil:
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
+
+func newMulticastConn(conn *net.UDPConn, multicastGroup *net.UDPAddr) multicastConn {
+	if multicastGroup.IP.To4() != nil {
+		return ipv4MulticastConn{ipv4.NewPacketConn(conn)}
+	}
+	return ipv6MulticastConn{ipv6.NewPacketConn(conn)}
+}
+
+func setMulticastOptions(packetConn multicastConn, config MulticastConfig) (err error) {
+	if config.Interface != nil {
+		err = packetConn.SetMulticastInterface(config.Interface)
+		if err != nil {
+			return
+		}
+	}
+	if config.TTL > 0 {
+		err = packetConn.SetMulticastHops(config.TTL)
+		if err != nil {
+			return
+		}
+	}
+	return packetConn.SetMulticastLoopback(config.Loopback)
+}
+
+func serveDiscovery(ctx context.Context, conn net.PacketConn, config DiscoveryConfig, discoveredNodes chan *DiscoveredNode, appSocket *net.TCPAddr) (err error) {
+	config = config.orDefault()
+	ctx, cancel := context.WithCancel(ctx)
+	var resolving sync.WaitGroup
+	//Nodes that looked this one up are told when it leaves
+	var recipientsMutex sync.Mutex
+	recipients := make(map[string]leavingRecipient)
+	limiter := newReplyLimiter(config.ReplyInterval)
+	local := newLocalAddresses(config.Interfaces)
 
 	closeChannel := make(chan error, 1)
 
 	go func() {
 		defer close(closeChannel)
 
-		readBuffer := make([]byte, bufferSize)
+		readBuffer := make([]byte, config.ReadBufferSize)
 		for {
 			read, addr, err := conn.ReadFrom(readBuffer)
 			if err != nil {
 				closeChannel <- err
 				return
 			}
-			buffer := bytes.NewBuffer(readBuffer[:read])
-			packet, err := ParsePacket(buffer)
+			packet, replyCodec, err := decodeDatagram(config.Codec, readBuffer[:read])
 			if err != nil {
 				continue
 			}
@@ -41,51 +305,111 @@ func DiscoveryService(ctx context.Context, discoveredNodes chan *net.TCPAddr, di
 			if !ok {
 				continue
 			}
-			deadline := time.Now().Add(writingSocketTimeout)
-			err = conn.SetWriteDeadline(deadline)
+			version, err := negotiateDiscoveryPacket(discoveryPacket)
 			if err != nil {
+				config.reportIncompatible(discoveryPacket, err)
+				continue
+			}
+			if isOwnDiscoveryPacket(discoveryPacket, appSocket, local) || !selectedSource(local, addr) {
+				continue
+			}
+			if discoveryPacket.Type == leavingDiscoveryType {
+				resolving.Add(1)
+				go resolveDiscoveryPacketTCPAddress(ctx, &resolving, discoveryPacket, version, discoveredNodes)
+				continue
+			}
+			//Answering RUNNING-APP replies would make two services ping-pong forever
+			if discoveryPacket.Type != requestDiscoveryType {
 				continue
 			}
-			responsePacket := NewResponseDiscoveryPacket(appSocket.IP, uint16(appSocket.Port))
-			responsePacketBytes, _ := responsePacket.Bytes()
-			_, err = conn.WriteTo(responsePacketBytes, addr)
-			if discoveryPacket.Type == requestDiscoveryType {
-				go resolveDiscoveryPacketTCPAddress(discoveryPacket, discoveredNodes)
+			resolving.Add(1)
+			go resolveDiscoveryPacketTCPAddress(ctx, &resolving, discoveryPacket, version, discoveredNodes)
+			metadata := config.metadata()
+			if !discoveryPacket.Query.Matches(metadata) {
+				continue
+			}
+			host := appSocket.IP
+			if udpAddr, ok := addr.(*net.UDPAddr); ok {
+				host, ok = local.hostFor(appSocket.IP, udpAddr.IP)
+				if !ok {
+					continue
+				}
+			}
+			recipientsMutex.Lock()
+			if len(recipients) < maxLeavingRecipients {
+				recipients[addr.String()] = leavingRecipient{addr, replyCodec, host}
 			}
+			recipientsMutex.Unlock()
+			if !limiter.allow(addr.String(), time.Now()) {
+				continue
+			}
+			deadline := time.Now().Add(config.WriteTimeout)
+			err = conn.SetWriteDeadline(deadline)
+			if err != nil {
+				continue
+			}
+			responsePacket := NewResponseDiscoveryPacket(host, uint16(appSocket.Port))
+			responsePacket.Metadata = metadata
+			signAnnouncement(&responsePacket, config.Identity)
+			responsePacketBytes, _ := replyCodec.Encode(&responsePacket)
+			conn.WriteTo(responsePacketBytes, addr)
 		}
 	}()
 
 	select {
 	case <-ctx.Done():
 		err = ctx.Err()
+		recipientsMutex.Lock()
+		for _, recipient := range recipients {
+			announceLeaving(conn, config, recipient.codec, recipient.host, uint16(appSocket.Port), probeTarget{addr: recipient.addr})
+		}
+		recipientsMutex.Unlock()
 	case err = <-closeChannel:
 	}
+	shutdownDiscovery(cancel, conn, &resolving, discoveredNodes, closeChannel)
 	return
 }
 
-func LookForNodes(ctx context.Context, discoveredNodes chan *net.TCPAddr, dstAddress *net.UDPAddr, appSocket *net.TCPAddr) (err error) {
-	conn, err := net.DialUDP("udp4", nil, dstAddress)
-	if err != nil {
-		return
-	}
-
-	defer conn.Close()
-	defer close(discoveredNodes)
+// A send on probes asks for an announcement before the next interval
+func lookForNodes(ctx context.Context, conn net.PacketConn, config DiscoveryConfig, discoveredNodes chan *DiscoveredNode, dstAddress *net.UDPAddr, appSocket *net.TCPAddr, probes chan struct{}) (err error) {
+	config = config.orDefault()
+	ctx, cancel := context.WithCancel(ctx)
+	var resolving sync.WaitGroup
+	local := newLocalAddresses(config.Interfaces)
 
 	closeSenderChannel := make(chan error, 1)
 
 	//Send Discovery Packet to the network
 	go func() {
 		defer close(closeSenderChannel)
-		for {
-			packet := NewRequestDiscoveryPacket(appSocket.IP, uint16(appSocket.Port))
-			packetBytes, _ := packet.Bytes()
-			_, err := conn.WriteToUDP(packetBytes, dstAddress)
-			if err != nil {
+		for sent := 1; ; sent++ {
+			//An interface going down must not stop discovery on the others
+			var err error
+			delivered := false
+			for _, target := range local.probeTargets(appSocket.IP, dstAddress, config.Multicast != nil) {
+				packet := NewRequestDiscoveryPacket(target.host, uint16(appSocket.Port))
+				packet.Query = config.Query
+				signAnnouncement(&packet, config.Identity)
+				packetBytes, _ := config.Codec.Encode(&packet)
+				if sendErr := target.send(conn, packetBytes); sendErr != nil {
+					err = sendErr
+				} else {
+					delivered = true
+				}
+			}
+			if !delivered {
 				closeSenderChannel <- err
 				return
 			}
-			time.Sleep(lookForNodesInterval)
+			timer := time.NewTimer(config.probeDelay(sent))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			case <-probes:
+				timer.Stop()
+			}
 		}
 	}()
 
@@ -93,15 +417,16 @@ func LookForNodes(ctx context.Context, discoveredNodes chan *net.TCPAddr, dstAdd
 
 	//Receive Discovery Packet from the network
 	go func() {
+		defer close(closeReceiverChannel)
+
+		readBuffer := make([]byte, config.ReadBufferSize)
 		for {
-			readBuffer := make([]byte, bufferSize)
-			read, _, err := conn.ReadFrom(readBuffer)
+			read, addr, err := conn.ReadFrom(readBuffer)
 			if err != nil {
 				closeReceiverChannel <- err
 				return
 			}
-			buffer := bytes.NewBuffer(readBuffer[:read])
-			packet, err := ParsePacket(buffer)
+			packet, _, err := decodeDatagram(config.Codec, readBuffer[:read])
 			if err != nil {
 				continue
 			}
@@ -109,23 +434,129 @@ func LookForNodes(ctx context.Context, discoveredNodes chan *net.TCPAddr, dstAdd
 			if !ok {
 				continue
 			}
-			go resolveDiscoveryPacketTCPAddress(discoveryPacket, discoveredNodes)
+			version, err := negotiateDiscoveryPacket(discoveryPacket)
+			if err != nil {
+				config.reportIncompatible(discoveryPacket, err)
+				continue
+			}
+			if isOwnDiscoveryPacket(discoveryPacket, appSocket, local) || !selectedSource(local, addr) {
+				continue
+			}
+			//Services that predate queries answer every request
+			if discoveryPacket.Type == responseDiscoveryType && !config.Query.Matches(discoveryPacket.Metadata) {
+				continue
+			}
+			resolving.Add(1)
+			go resolveDiscoveryPacketTCPAddress(ctx, &resolving, discoveryPacket, version, discoveredNodes)
 		}
 	}()
 
 	select {
 	case <-ctx.Done():
 		err = ctx.Err()
+		for _, target := range local.probeTargets(appSocket.IP, dstAddress, config.Multicast != nil) {
+			announceLeaving(conn, config, config.Codec, target.host, uint16(appSocket.Port), target)
+		}
 	case err = <-closeSenderChannel:
 	case err = <-closeReceiverChannel:
 	}
+	shutdownDiscovery(cancel, conn, &resolving, discoveredNodes, closeSenderChannel, closeReceiverChannel)
 	return
 }
 
-func resolveDiscoveryPacketTCPAddress(discoveryPacket *DiscoveryPacket, resultChannel chan *net.TCPAddr) {
-	address := fmt.Sprintf("%s:%d", discoveryPacket.Address, discoveryPacket.Port)
-	theirAppSocket, err := net.ResolveTCPAddr("tcp4", address)
+func announceLeaving(conn net.PacketConn, config DiscoveryConfig, codec Codec, host net.IP, port uint16, target probeTarget) {
+	packet := NewLeavingDiscoveryPacket(host, port)
+	signAnnouncement(&packet, config.Identity)
+	packetBytes, err := codec.Encode(&packet)
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+	target.send(conn, packetBytes)
+}
+
+func signAnnouncement(packet *DiscoveryPacket, identity ed25519.PrivateKey) {
+	if identity != nil {
+		packet.Sign(identity)
+	}
+}
+
+func shutdownDiscovery(cancel context.CancelFunc, conn net.PacketConn, resolving *sync.WaitGroup, discoveredNodes chan *DiscoveredNode, closeChannels ...chan error) {
+	cancel()
+	conn.Close()
+	for _, closeChannel := range closeChannels {
+		for range closeChannel {
+		}
+	}
+	resolving.Wait()
+	close(discoveredNodes)
+}
+
+// The protocol version to talk to the announced node with
+func negotiateDiscoveryPacket(discoveryPacket *DiscoveryPacket) (uint8, error) {
+	//Unsigned packets are accepted without a NODE-ID, but a claimed identity must be proven
+	if discoveryPacket.NodeID != nil {
+		err := discoveryPacket.Verify()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return discoveryPacket.NegotiateVersion()
+}
+
+// A node reached through its own discovery socket must not discover itself. An
+// app bound to every interface may advertise any of their addresses
+func isOwnDiscoveryPacket(discoveryPacket *DiscoveryPacket, appSocket *net.TCPAddr, local *localAddresses) bool {
+	if int(discoveryPacket.Port) != appSocket.Port {
+		return false
+	}
+	if appSocket.IP == nil || appSocket.IP.IsUnspecified() {
+		return discoveryPacket.Address.Equal(appSocket.IP) || discoveryPacket.Address.IsLoopback() || local.isLocal(discoveryPacket.Address)
+	}
+	return discoveryPacket.Address.Equal(appSocket.IP)
+}
+
+// Discovery only runs on the selected interfaces, packets arriving through others are dropped
+func selectedSource(local *localAddresses, addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	return !ok || local.selects(udpAddr.IP)
+}
+
+func newReplyLimiter(interval time.Duration) *replyLimiter {
+	return &replyLimiter{interval, make(map[string]time.Time)}
+}
+
+func (limiter *replyLimiter) allow(source string, now time.Time) bool {
+	if replied, ok := limiter.replied[source]; ok && now.Sub(replied) < limiter.interval {
+		return false
+	}
+	if len(limiter.replied) >= maxReplySources {
+		for key, replied := range limiter.replied {
+			if now.Sub(replied) >= limiter.interval {
+				delete(limiter.replied, key)
+			}
+		}
+		//Sources beyond the limit are only answered once older ones expire
+		if len(limiter.replied) >= maxReplySources {
+			return false
+		}
+	}
+	limiter.replied[source] = now
+	return true
+}
+
+// An unspecified HOST, like the one of dyllable discover, is answered but names no node to discover
+func resolveDiscoveryPacketTCPAddress(ctx context.Context, resolving *sync.WaitGroup, discoveryPacket *DiscoveryPacket, version uint8, resultChannel chan *DiscoveredNode) {
+	defer resolving.Done()
+	if discoveryPacket.Address.IsUnspecified() {
+		return
+	}
+	address := net.JoinHostPort(discoveryPacket.Address.String(), strconv.Itoa(int(discoveryPacket.Port)))
+	theirAppSocket, err := net.ResolveTCPAddr("tcp", address)
 	if err == nil {
-		resultChannel <- theirAppSocket
+		select {
+		case resultChannel <- &DiscoveredNode{theirAppSocket, discoveryPacket.NodeID, discoveryPacket.Type == leavingDiscoveryType, version, discoveryPacket.Metadata, discoveryPacket.Timestamp, discoveryPacket.Type == requestDiscoveryType}:
+		case <-ctx.Done():
+		}
 	}
 }
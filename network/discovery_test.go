@@ -3,27 +3,37 @@ package network
 import (
 	"bytes"
 	"context"
-	"fmt"
+	"errors"
 	"net"
-	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestDiscoveryServiceAnySocket(t *testing.T) {
-	discoveredNodes := make(chan *net.TCPAddr, 5)
+	discoveredNodes := make(chan *DiscoveredNode, 5)
 	discoverySocket, err := net.ResolveUDPAddr("udp4", "0.0.0.0:8400")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 
-	ifaces, err := listIPV4LocalInterfaces()
-
-	appIPPort := fmt.Sprintf("%s:8401", ifaces[0])
-	appSocket, err := net.ResolveTCPAddr("tcp4", appIPPort)
+	addresses, err := ListInterfaceAddresses(nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var appIP net.IP
+	for _, address := range addresses {
+		if appIP == nil && address.IP().To4() != nil {
+			appIP = address.IP()
+		}
+	}
+	appSocket := &net.TCPAddr{IP: appIP, Port: 8401}
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	go DiscoveryService(ctx, discoveredNodes, discoverySocket, appSocket)
+	go DiscoveryService(ctx, discoveredNodes, discoverySocket, appSocket, DiscoveryConfig{})
+
+	//Give the Discovery Service time to bind its socket
+	time.Sleep(100 * time.Millisecond)
 
 	conn, err := net.DialUDP("udp4", nil, discoverySocket)
 	if err != nil {
@@ -55,14 +65,14 @@ func TestDiscoveryServiceAnySocket(t *testing.T) {
 	if !ok {
 		t.Fatalf("%v", err)
 	}
-	if discoveryResponsePacket.Address.String() == appIPPort {
-		t.Fatalf("Expecting the app running in a valid IP not %s", discoveryResponsePacket.Address)
+	if !discoveryResponsePacket.Address.Equal(appIP) {
+		t.Fatalf("Expecting the app running in %s not %s", appIP, discoveryResponsePacket.Address)
 	}
 	if discoveryResponsePacket.Port != 8401 {
 		t.Fatalf("Expecting the app running in port 8401 instead of %d", discoveryResponsePacket.Port)
 	}
 
-	var discoveredNode *net.TCPAddr
+	var discoveredNode *DiscoveredNode
 
 	select {
 	case discoveredNode = <-discoveredNodes:
@@ -70,11 +80,11 @@ func TestDiscoveryServiceAnySocket(t *testing.T) {
 		t.Fatal("Discovery Service did return the other app socket")
 	}
 
-	if discoveredNode.IP.String() != otherAppSocket.IP.String() {
-		t.Fatalf("Expecting other app socket IP equals to %d instead of %d", discoveredNode.IP, otherAppSocket.IP)
+	if discoveredNode.Address.IP.String() != otherAppSocket.IP.String() {
+		t.Fatalf("Expecting other app socket IP equals to %d instead of %d", discoveredNode.Address.IP, otherAppSocket.IP)
 	}
-	if discoveredNode.Port != otherAppSocket.Port {
-		t.Fatalf("Expecting other app socket port equals to %d instead of %d", discoveredNode.Port, otherAppSocket.Port)
+	if discoveredNode.Address.Port != otherAppSocket.Port {
+		t.Fatalf("Expecting other app socket port equals to %d instead of %d", discoveredNode.Address.Port, otherAppSocket.Port)
 	}
 
 	deadline := time.Now().Add(1 * time.Second)
@@ -100,30 +110,579 @@ func TestDiscoveryServiceAnySocket(t *testing.T) {
 	}
 }
 
+func TestDiscoveryServiceIgnoresIncompatibleVersion(t *testing.T) {
+	discoverySocket, err := net.ResolveUDPAddr("udp4", "127.0.0.1:8408")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	appSocket, err := net.ResolveTCPAddr("tcp4", "10.0.10.1:8409")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	discoveredNodes := make(chan *DiscoveredNode, 5)
+	incompatible := make(chan error, 1)
+	config := DiscoveryConfig{Incompatible: func(node *DiscoveredNode, err error) {
+		incompatible <- err
+	}}
+	go DiscoveryService(ctx, discoveredNodes, discoverySocket, appSocket, config)
+
+	//Give the Discovery Service time to bind its socket
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialUDP("udp4", nil, discoverySocket)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+
+	futurePacket := NewRequestDiscoveryPacket(net.IPv4(10, 0, 10, 2), 8409)
+	futurePacket.Version = ProtocolVersion + 2
+	futurePacket.MinVersion = ProtocolVersion + 1
+	futurePacketBytes, _ := futurePacket.Bytes()
+	conn.Write(futurePacketBytes)
+
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	readBuffer := make([]byte, 1024)
+	_, _, err = conn.ReadFrom(readBuffer)
+	if err == nil {
+		t.Fatal("DiscoveryService should not answer a peer with an incompatible version")
+	}
+	select {
+	case node := <-discoveredNodes:
+		t.Fatalf("peer with an incompatible version should not be discovered: %s", node)
+	default:
+	}
+	var versionErr *IncompatibleVersionError
+	select {
+	case err := <-incompatible:
+		if !errors.As(err, &versionErr) {
+			t.Fatalf("expected an IncompatibleVersionError instead of %v", err)
+		}
+	default:
+		t.Fatal("peer with an incompatible version should be reported")
+	}
+}
+
 func TestDiscoveryServiceMulticastSocket(t *testing.T) {
-	t.Error("Not implemented yet")
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8402")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	appSocket, err := net.ResolveTCPAddr("tcp4", "10.0.10.1:8403")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	otherAppSocket, err := net.ResolveTCPAddr("tcp4", "10.0.10.2:8403")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	serviceNodes := make(chan *DiscoveredNode, 5)
+	go MulticastDiscoveryService(ctx, serviceNodes, multicastGroup, appSocket, config)
+
+	//Give the Discovery Service time to join the group
+	time.Sleep(100 * time.Millisecond)
+
+	lookingNodes := make(chan *DiscoveredNode, 5)
+	go MulticastLookForNodes(ctx, lookingNodes, multicastGroup, otherAppSocket, config)
+
+	var discoveredNode *DiscoveredNode
+
+	select {
+	case discoveredNode = <-lookingNodes:
+	case <-time.After(1 * time.Second):
+		t.Fatal("LookForNodes did not receive a response through the multicast group")
+	}
+	if discoveredNode.Address.String() != appSocket.String() {
+		t.Fatalf("Expecting discovered node %s instead of %s", appSocket, discoveredNode)
+	}
+
+	select {
+	case discoveredNode = <-serviceNodes:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Discovery Service did not receive the request through the multicast group")
+	}
+	if discoveredNode.Address.String() != otherAppSocket.String() {
+		t.Fatalf("Expecting discovered node %s instead of %s", otherAppSocket, discoveredNode)
+	}
+
+	<-ctx.Done()
+
+	for range lookingNodes {
+	}
+	for range serviceNodes {
+	}
 }
 
-func listIPV4LocalInterfaces() ([]string, error) {
-	var addresses []string
+func TestMulticastDiscoveryServiceInvalidGroup(t *testing.T) {
+	notMulticastGroup, err := net.ResolveUDPAddr("udp4", "127.0.0.1:8402")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	appSocket, err := net.ResolveTCPAddr("tcp4", "10.0.10.1:8403")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = MulticastDiscoveryService(context.Background(), make(chan *DiscoveredNode), notMulticastGroup, appSocket, MulticastConfig{})
+	if err == nil {
+		t.Fatal("MulticastDiscoveryService should not join a unicast address")
+	}
+}
+
+func TestLookForNodesIPv6(t *testing.T) {
+	discoverySocket, err := net.ResolveUDPAddr("udp6", "[::1]:8404")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	appSocket, err := net.ResolveTCPAddr("tcp6", "[fd00::1]:8405")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	otherAppSocket, err := net.ResolveTCPAddr("tcp6", "[fd00::2]:8405")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	serviceNodes := make(chan *DiscoveredNode, 5)
+	go DiscoveryService(ctx, serviceNodes, discoverySocket, appSocket, DiscoveryConfig{})
+
+	//Give the Discovery Service time to bind its socket
+	time.Sleep(100 * time.Millisecond)
+
+	lookingNodes := make(chan *DiscoveredNode, 5)
+	go LookForNodes(ctx, lookingNodes, discoverySocket, otherAppSocket, DiscoveryConfig{})
+
+	var discoveredNode *DiscoveredNode
+
+	select {
+	case discoveredNode = <-lookingNodes:
+	case <-time.After(1 * time.Second):
+		t.Fatal("LookForNodes did not receive a response over IPv6")
+	}
+	if discoveredNode.Address.String() != appSocket.String() {
+		t.Fatalf("Expecting discovered node %s instead of %s", appSocket, discoveredNode)
+	}
+
+	select {
+	case discoveredNode = <-serviceNodes:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Discovery Service did not receive the request over IPv6")
+	}
+	if discoveredNode.Address.String() != otherAppSocket.String() {
+		t.Fatalf("Expecting discovered node %s instead of %s", otherAppSocket, discoveredNode)
+	}
+}
+
+func TestDiscoveryServiceIPv6MulticastSocket(t *testing.T) {
+	iface, err := findMulticastInterface(true)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+
+	multicastGroup := &net.UDPAddr{IP: net.ParseIP("ff02::8406"), Port: 8406, Zone: iface.Name}
+	appSocket, err := net.ResolveTCPAddr("tcp6", "[fd00::1]:8407")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	otherAppSocket, err := net.ResolveTCPAddr("tcp6", "[fd00::2]:8407")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	serviceNodes := make(chan *DiscoveredNode, 5)
+	go MulticastDiscoveryService(ctx, serviceNodes, multicastGroup, appSocket, config)
+
+	//Give the Discovery Service time to join the group
+	time.Sleep(100 * time.Millisecond)
+
+	lookingNodes := make(chan *DiscoveredNode, 5)
+	go MulticastLookForNodes(ctx, lookingNodes, multicastGroup, otherAppSocket, config)
+
+	var discoveredNode *DiscoveredNode
+
+	select {
+	case discoveredNode = <-lookingNodes:
+	case <-time.After(1 * time.Second):
+		t.Fatal("LookForNodes did not receive a response through the IPv6 multicast group")
+	}
+	if discoveredNode.Address.String() != appSocket.String() {
+		t.Fatalf("Expecting discovered node %s instead of %s", appSocket, discoveredNode)
+	}
+
+	select {
+	case discoveredNode = <-serviceNodes:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Discovery Service did not receive the request through the IPv6 multicast group")
+	}
+	if discoveredNode.Address.String() != otherAppSocket.String() {
+		t.Fatalf("Expecting discovered node %s instead of %s", otherAppSocket, discoveredNode)
+	}
+}
+
+func findMulticastInterface(ipv6 bool) (*net.Interface, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, err
 	}
-	for _, i := range ifaces {
-		addrs, err := i.Addrs()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
 		if err != nil {
 			continue
 		}
 		for _, a := range addrs {
-			switch v := a.(type) {
-			case *net.IPNet:
-				if strings.Count(v.IP.String(), ":") < 2 {
-					addresses = append(addresses, v.IP.String())
-				}
+			if v, ok := a.(*net.IPNet); ok && (v.IP.To4() == nil) == ipv6 {
+				multicastIface := iface
+				return &multicastIface, nil
 			}
+		}
+	}
+	if ipv6 {
+		return nil, errors.New("no IPv6 multicast interface available")
+	}
+	return nil, errors.New("no IPv4 multicast interface available")
+}
+
+func TestDiscoveryAnnouncesLeaving(t *testing.T) {
+	serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lookupConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	serviceSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8421}
+	lookupSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8422}
+	identity, _ := GenerateNodeIdentity()
+
+	serviceCtx, stopService := context.WithCancel(context.Background())
+	defer stopService()
+	lookupCtx, stopLookup := context.WithCancel(context.Background())
+	defer stopLookup()
+	serviceNodes := make(chan *DiscoveredNode, 2)
+	lookupNodes := make(chan *DiscoveredNode, 2)
+	go serveDiscovery(serviceCtx, serviceConn, DiscoveryConfig{Identity: identity}, serviceNodes, serviceSocket)
+	go lookForNodes(lookupCtx, lookupConn, DiscoveryConfig{BurstProbes: -1}, lookupNodes, serviceConn.LocalAddr().(*net.UDPAddr), lookupSocket, nil)
+
+	expectNode := func(nodes chan *DiscoveredNode, address *net.TCPAddr, leaving bool) {
+		select {
+		case node := <-nodes:
+			if node.Address.String() != address.String() || node.Leaving != leaving {
+				t.Fatalf("expected %s with leaving %v instead of %s with leaving %v", address, leaving, node, node.Leaving)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s was not discovered with leaving %v", address, leaving)
+		}
+	}
+	expectNode(lookupNodes, serviceSocket, false)
+	expectNode(serviceNodes, lookupSocket, false)
+
+	//The service tells the nodes that looked it up, and the lookup tells where it sends requests
+	stopService()
+	expectNode(lookupNodes, serviceSocket, true)
+
+	serviceConn, err = net.ListenUDP("udp4", serviceConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer serviceConn.Close()
+	serviceNodes = make(chan *DiscoveredNode, 2)
+	go serveDiscovery(context.Background(), serviceConn, DiscoveryConfig{}, serviceNodes, serviceSocket)
+	stopLookup()
+	expectNode(serviceNodes, lookupSocket, true)
+}
+
+type countingPacketConn struct {
+	net.PacketConn
+	writes int32
+}
+
+func (conn *countingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	atomic.AddInt32(&conn.writes, 1)
+	return conn.PacketConn.WriteTo(b, addr)
+}
+
+func TestDiscoveryServicesDoNotAnswerEachOther(t *testing.T) {
+	firstConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	secondConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	first := &countingPacketConn{PacketConn: firstConn}
+	second := &countingPacketConn{PacketConn: secondConn}
+	firstSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8423}
+	secondSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8424}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstNodes := make(chan *DiscoveredNode, 2)
+	secondNodes := make(chan *DiscoveredNode, 2)
+	go serveDiscovery(ctx, first, DiscoveryConfig{}, firstNodes, firstSocket)
+	go serveDiscovery(ctx, second, DiscoveryConfig{}, secondNodes, secondSocket)
+
+	//A stray RUNNING-APP used to be answered with another RUNNING-APP, forever
+	response := NewResponseDiscoveryPacket(firstSocket.IP, uint16(firstSocket.Port))
+	responseBytes, _ := response.Bytes()
+	first.WriteTo(responseBytes, second.LocalAddr())
+
+	time.Sleep(300 * time.Millisecond)
+	if writes := atomic.LoadInt32(&first.writes); writes != 1 {
+		t.Fatalf("expected only the stray response to be written by the first service instead of %d packets", writes)
+	}
+	if writes := atomic.LoadInt32(&second.writes); writes != 0 {
+		t.Fatalf("second service should not answer a RUNNING-APP response, wrote %d packets", writes)
+	}
+	select {
+	case node := <-secondNodes:
+		t.Fatalf("a RUNNING-APP response should not be discovered by a service: %s", node)
+	default:
+	}
+
+	//Requests are still answered
+	request := NewRequestDiscoveryPacket(firstSocket.IP, uint16(firstSocket.Port))
+	requestBytes, _ := request.Bytes()
+	first.WriteTo(requestBytes, second.LocalAddr())
+	select {
+	case node := <-secondNodes:
+		if node.Address.String() != firstSocket.String() {
+			t.Fatalf("expected %s to be discovered instead of %s", firstSocket, node)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second service did not discover the first one")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if writes := atomic.LoadInt32(&second.writes); writes != 1 {
+		t.Fatalf("expected the second service to answer the request once instead of %d times", writes)
+	}
+	if writes := atomic.LoadInt32(&first.writes); writes != 2 {
+		t.Fatalf("first service should not answer the RUNNING-APP reply, wrote %d packets", writes)
+	}
+
+	cancel()
+	for range firstNodes {
+	}
+	for range secondNodes {
+	}
+}
+
+func TestDiscoveryServiceIgnoresItself(t *testing.T) {
+	serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	clientConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clientConn.Close()
+	serviceSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8425}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serviceNodes := make(chan *DiscoveredNode, 2)
+	go serveDiscovery(ctx, serviceConn, DiscoveryConfig{}, serviceNodes, serviceSocket)
+
+	request := NewRequestDiscoveryPacket(serviceSocket.IP, uint16(serviceSocket.Port))
+	requestBytes, _ := request.Bytes()
+	clientConn.WriteTo(requestBytes, serviceConn.LocalAddr())
+
+	readBuffer := make([]byte, bufferSize)
+	clientConn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, _, err = clientConn.ReadFrom(readBuffer)
+	if err == nil {
+		t.Fatal("DiscoveryService should not answer its own announcement")
+	}
+	select {
+	case node := <-serviceNodes:
+		t.Fatalf("DiscoveryService should not discover itself: %s", node)
+	default:
+	}
+}
 
+func TestDiscoveryServiceRateLimitsReplies(t *testing.T) {
+	serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	clientConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clientConn.Close()
+	serviceSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8426}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serviceNodes := make(chan *DiscoveredNode, 10)
+	go serveDiscovery(ctx, serviceConn, DiscoveryConfig{}, serviceNodes, serviceSocket)
+
+	request := NewRequestDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8427)
+	requestBytes, _ := request.Bytes()
+	for i := 0; i < 5; i++ {
+		clientConn.WriteTo(requestBytes, serviceConn.LocalAddr())
+	}
+
+	replies := 0
+	readBuffer := make([]byte, bufferSize)
+	for {
+		clientConn.SetReadDeadline(time.Now().Add(DefaultDiscoveryConfig.ReplyInterval / 2))
+		_, _, err = clientConn.ReadFrom(readBuffer)
+		if err != nil {
+			break
+		}
+		replies++
+	}
+	if replies != 1 {
+		t.Fatalf("expected a burst of requests to be answered once instead of %d times", replies)
+	}
+
+	//The source is answered again once the interval has passed
+	time.Sleep(DefaultDiscoveryConfig.ReplyInterval)
+	clientConn.WriteTo(requestBytes, serviceConn.LocalAddr())
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = clientConn.ReadFrom(readBuffer)
+	if err != nil {
+		t.Fatalf("DiscoveryService should answer again after the interval: %v", err)
+	}
+}
+
+func TestReplyLimiter(t *testing.T) {
+	limiter := newReplyLimiter(time.Second)
+	now := time.Now()
+	if !limiter.allow("a", now) || !limiter.allow("b", now) {
+		t.Fatal("first reply to each source should be allowed")
+	}
+	if limiter.allow("a", now.Add(500*time.Millisecond)) {
+		t.Fatal("second reply within the interval should be limited")
+	}
+	if !limiter.allow("a", now.Add(time.Second)) {
+		t.Fatal("reply after the interval should be allowed")
+	}
+}
+
+func TestDiscoveryConfigProbeDelay(t *testing.T) {
+	config := DiscoveryConfig{ProbeInterval: time.Second, ProbeJitter: 0.2, BurstProbes: 2, BurstInterval: 50 * time.Millisecond}.orDefault()
+	for sent := 1; sent <= 2; sent++ {
+		if delay := config.probeDelay(sent); delay != 50*time.Millisecond {
+			t.Fatalf("expected burst delay after %d requests instead of %s", sent, delay)
 		}
 	}
-	return addresses, nil
+	for i := 0; i < 100; i++ {
+		delay := config.probeDelay(3)
+		if delay < 800*time.Millisecond || delay > 1200*time.Millisecond {
+			t.Fatalf("expected a jittered delay around the interval instead of %s", delay)
+		}
+	}
+
+	config = DiscoveryConfig{ProbeInterval: time.Second, ProbeJitter: 5, BurstProbes: -1}.orDefault()
+	for i := 0; i < 100; i++ {
+		if delay := config.probeDelay(1); delay <= 0 {
+			t.Fatalf("a jitter over 1 should still leave a positive delay, got %s", delay)
+		}
+	}
+
+	config = DiscoveryConfig{ProbeInterval: time.Second, ProbeJitter: -1, BurstProbes: -1}.orDefault()
+	if delay := config.probeDelay(1); delay != time.Second {
+		t.Fatalf("expected the exact interval without burst and jitter instead of %s", delay)
+	}
+	if config.ReadBufferSize != DefaultDiscoveryConfig.ReadBufferSize || config.Codec == nil {
+		t.Fatal("zero fields should fall back to DefaultDiscoveryConfig")
+	}
+}
+
+func TestLookForNodesBurstFindsLateService(t *testing.T) {
+	serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	serviceAddress := serviceConn.LocalAddr().(*net.UDPAddr)
+	//The first request is lost while no service is listening
+	serviceConn.Close()
+	lookupConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	serviceSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8435}
+	lookupSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8436}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lookupNodes := make(chan *DiscoveredNode, 4)
+	config := DiscoveryConfig{ProbeInterval: time.Minute, BurstProbes: 3, BurstInterval: 100 * time.Millisecond}
+	go lookForNodes(ctx, lookupConn, config, lookupNodes, serviceAddress, lookupSocket, nil)
+
+	time.Sleep(50 * time.Millisecond)
+	serviceConn, err = net.ListenUDP("udp4", serviceAddress)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	serviceNodes := make(chan *DiscoveredNode, 4)
+	go serveDiscovery(ctx, serviceConn, DiscoveryConfig{}, serviceNodes, serviceSocket)
+
+	select {
+	case node := <-lookupNodes:
+		if node.Address.String() != serviceSocket.String() {
+			t.Fatalf("expected %s to be discovered instead of %s", serviceSocket, node)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("burst probes should find a service started after the first request")
+	}
+}
+
+func TestDiscoveryServiceAnswersUnspecifiedHostWithoutDiscoveringIt(t *testing.T) {
+	serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	clientConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clientConn.Close()
+	serviceSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8429}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serviceNodes := make(chan *DiscoveredNode, 2)
+	go serveDiscovery(ctx, serviceConn, DiscoveryConfig{}, serviceNodes, serviceSocket)
+
+	request := NewRequestDiscoveryPacket(net.IPv6unspecified, uint16(clientConn.LocalAddr().(*net.UDPAddr).Port))
+	requestBytes, _ := request.Bytes()
+	clientConn.WriteTo(requestBytes, serviceConn.LocalAddr())
+
+	readBuffer := make([]byte, bufferSize)
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = clientConn.ReadFrom(readBuffer)
+	if err != nil {
+		t.Fatalf("DiscoveryService should answer a request with an unspecified HOST: %v", err)
+	}
+	select {
+	case node := <-serviceNodes:
+		t.Fatalf("an unspecified HOST should not be discovered: %s", node)
+	case <-time.After(100 * time.Millisecond):
+	}
 }
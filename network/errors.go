@@ -0,0 +1,71 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrMalformedPacket = errors.New("malformed packet")
+var ErrUnknownIdentifier = fmt.Errorf("%w: identifier not known", ErrMalformedPacket)
+var ErrTruncatedPacket = fmt.Errorf("%w: truncated packet", ErrMalformedPacket)
+var ErrTooManyHeaders = fmt.Errorf("%w: too many header lines", ErrMalformedPacket)
+var ErrHeaderTooLong = fmt.Errorf("%w: header line too long", ErrMalformedPacket)
+var ErrBodyTooLarge = fmt.Errorf("%w: body too large", ErrMalformedPacket)
+
+type MissingHeaderError struct {
+	Header string
+}
+
+type InvalidHeaderValueError struct {
+	Header string
+	Value  string
+	Err    error
+}
+
+type InvalidHeaderLineError struct {
+	Line string
+}
+
+type InvalidBodyError struct {
+	Err error
+}
+
+func (err *MissingHeaderError) Error() string {
+	return fmt.Sprintf("malformed packet: \"%s\" header not found", err.Header)
+}
+
+func (err *MissingHeaderError) Is(target error) bool {
+	return target == ErrMalformedPacket
+}
+
+func (err *InvalidHeaderValueError) Error() string {
+	return fmt.Sprintf("malformed packet: invalid %s \"%s\": %v", err.Header, err.Value, err.Err)
+}
+
+func (err *InvalidHeaderValueError) Is(target error) bool {
+	return target == ErrMalformedPacket
+}
+
+func (err *InvalidHeaderValueError) Unwrap() error {
+	return err.Err
+}
+
+func (err *InvalidHeaderLineError) Error() string {
+	return fmt.Sprintf("malformed packet: invalid header line \"%s\"", err.Line)
+}
+
+func (err *InvalidHeaderLineError) Is(target error) bool {
+	return target == ErrMalformedPacket
+}
+
+func (err *InvalidBodyError) Error() string {
+	return fmt.Sprintf("malformed packet: invalid body: %v", err.Err)
+}
+
+func (err *InvalidBodyError) Is(target error) bool {
+	return target == ErrMalformedPacket
+}
+
+func (err *InvalidBodyError) Unwrap() error {
+	return err.Err
+}
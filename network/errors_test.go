@@ -0,0 +1,135 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParsePacketErrors(t *testing.T) {
+	requestUUID := "95bcd112-c138-4ca6-9df9-f4c508b9c0c1"
+
+	sentinelErrors := map[string]error{
+		"DYLLABLE-DYSCOVERY\r\n" +
+			"TYPE: DISCOVERY\r\n" +
+			"\r\n": ErrUnknownIdentifier,
+		"DYLLABLE-DISCOVERY": ErrTruncatedPacket,
+		"DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: DISCOVERY\r\n": ErrTruncatedPacket,
+		"DYLLABLE-ACTION-REQUEST\r\n" +
+			"REQUEST-UUID: " + requestUUID + "\r\n": ErrTruncatedPacket,
+	}
+	for packetString, expected := range sentinelErrors {
+		_, err := ParsePacket(bytes.NewBuffer([]byte(packetString)))
+		if !errors.Is(err, expected) {
+			t.Fatalf("expected %v instead of %v for packet:\n%s", expected, err, packetString)
+		}
+		if !errors.Is(err, ErrMalformedPacket) {
+			t.Fatalf("expected %v to be a ErrMalformedPacket", err)
+		}
+	}
+
+	missingHeaders := map[string]string{
+		"DYLLABLE-DISCOVERY\r\n" +
+			"HOST: 127.0.0.1:8400\r\n" +
+			"\r\n": "TYPE",
+		"DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: DISCOVERY\r\n" +
+			"\r\n": "HOST",
+		"DYLLABLE-ACTION-REQUEST\r\n" +
+			"ACTION-ID: 1\r\n" +
+			"\r\n": "REQUEST-UUID",
+		"DYLLABLE-ACTION-REQUEST\r\n" +
+			"REQUEST-UUID: " + requestUUID + "\r\n" +
+			"\r\n": "ACTION-ID",
+		"DYLLABLE-ACTION-RESPONSE\r\n" +
+			"APPROVED: True\r\n" +
+			"\r\n": "REQUEST-UUID",
+		"DYLLABLE-ACTION-RESPONSE\r\n" +
+			"REQUEST-UUID: " + requestUUID + "\r\n" +
+			"\r\n": "APPROVED",
+	}
+	for packetString, header := range missingHeaders {
+		_, err := ParsePacket(bytes.NewBuffer([]byte(packetString)))
+		var missingErr *MissingHeaderError
+		if !errors.As(err, &missingErr) {
+			t.Fatalf("expected MissingHeaderError instead of %v for packet:\n%s", err, packetString)
+		}
+		if missingErr.Header != header {
+			t.Fatalf("expected missing header %s instead of %s", header, missingErr.Header)
+		}
+		if !errors.Is(err, ErrMalformedPacket) {
+			t.Fatalf("expected %v to be a ErrMalformedPacket", err)
+		}
+	}
+
+	invalidValues := map[string]string{
+		"DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: INVALID\r\n" +
+			"HOST: 127.0.0.1:8400\r\n" +
+			"\r\n": "TYPE",
+		"DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: DISCOVERY\r\n" +
+			"HOST: localhost:8400\r\n" +
+			"\r\n": "HOST",
+		"DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: DISCOVERY\r\n" +
+			"HOST: 127.0.0.1:84000\r\n" +
+			"\r\n": "HOST",
+		"DYLLABLE-ACTION-REQUEST\r\n" +
+			"REQUEST-UUID: 1\r\n" +
+			"ACTION-ID: 1\r\n" +
+			"\r\n": "REQUEST-UUID",
+		"DYLLABLE-ACTION-REQUEST\r\n" +
+			"REQUEST-UUID: " + requestUUID + "\r\n" +
+			"ACTION-ID: 256\r\n" +
+			"\r\n": "ACTION-ID",
+		"DYLLABLE-ACTION-RESPONSE\r\n" +
+			"REQUEST-UUID: " + requestUUID + "\r\n" +
+			"APPROVED: true\r\n" +
+			"\r\n": "APPROVED",
+		"DYLLABLE-ACTION-RESPONSE\r\n" +
+			"REQUEST-UUID: " + requestUUID + "\r\n" +
+			"APPROVED: True\r\n" +
+			"VERSION: 0\r\n" +
+			"\r\n": "VERSION",
+		"DYLLABLE-ACTION-RESPONSE\r\n" +
+			"REQUEST-UUID: " + requestUUID + "\r\n" +
+			"APPROVED: True\r\n" +
+			"CONTENT-LENGTH: -1\r\n" +
+			"\r\n" +
+			"{}\r\n" +
+			"\r\n": "CONTENT-LENGTH",
+	}
+	for packetString, header := range invalidValues {
+		_, err := ParsePacket(bytes.NewBuffer([]byte(packetString)))
+		var invalidErr *InvalidHeaderValueError
+		if !errors.As(err, &invalidErr) {
+			t.Fatalf("expected InvalidHeaderValueError instead of %v for packet:\n%s", err, packetString)
+		}
+		if invalidErr.Header != header {
+			t.Fatalf("expected invalid header %s instead of %s", header, invalidErr.Header)
+		}
+		if !errors.Is(err, ErrMalformedPacket) {
+			t.Fatalf("expected %v to be a ErrMalformedPacket", err)
+		}
+	}
+
+	_, err := ParsePacket(bytes.NewBuffer([]byte("DYLLABLE-DISCOVERY\r\nTYPE DISCOVERY\r\n\r\n")))
+	var lineErr *InvalidHeaderLineError
+	if !errors.As(err, &lineErr) || lineErr.Line != "TYPE DISCOVERY" {
+		t.Fatalf("expected InvalidHeaderLineError instead of %v", err)
+	}
+
+	packetString := "DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: " + requestUUID + "\r\n" +
+		"ACTION-ID: 1\r\n" +
+		"\r\n" +
+		"{\"key\":}\r\n" +
+		"\r\n"
+	_, err = ParsePacket(bytes.NewBuffer([]byte(packetString)))
+	var bodyErr *InvalidBodyError
+	if !errors.As(err, &bodyErr) || !errors.Is(err, ErrMalformedPacket) {
+		t.Fatalf("expected InvalidBodyError instead of %v", err)
+	}
+}
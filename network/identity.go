@@ -0,0 +1,121 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrUnsignedDiscovery = errors.New("discovery packet has no NODE-ID and SIGNATURE")
+var ErrInvalidNodeSignature = errors.New("discovery packet SIGNATURE does not match NODE-ID")
+
+type DiscoveredNode struct {
+	Address *net.TCPAddr
+	NodeID  ed25519.PublicKey
+	//Set when the node announced with LEAVING that it is shutting down
+	Leaving bool
+	//Highest protocol version both the node and this one support
+	Version  uint8
+	Metadata DiscoveryMetadata
+	//When the node signed the announcement, zero for unsigned ones
+	Announced time.Time
+	//Set when the node was seen through its DISCOVERY request, which carries a query instead of metadata
+	Requesting bool
+}
+
+func GenerateNodeIdentity() (ed25519.PrivateKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	return privateKey, err
+}
+
+// Reads a PEM encoded Ed25519 key, creating it on the first run so the node keeps its identity
+func LoadNodeIdentity(path string) (privateKey ed25519.PrivateKey, err error) {
+	keyPEM, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createNodeIdentity(path)
+	}
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PRIVATE KEY block found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %T is not an Ed25519 key", path, key)
+	}
+	return
+}
+
+func createNodeIdentity(path string) (privateKey ed25519.PrivateKey, err error) {
+	privateKey, err = GenerateNodeIdentity()
+	if err != nil {
+		return
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	err = pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+	return
+}
+
+func FormatNodeID(nodeID ed25519.PublicKey) string {
+	return hex.EncodeToString(nodeID)
+}
+
+func ParseNodeID(value string) (ed25519.PublicKey, error) {
+	nodeID, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodeID) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("NODE-ID must be %d bytes instead of %d", ed25519.PublicKeySize, len(nodeID))
+	}
+	return ed25519.PublicKey(nodeID), nil
+}
+
+func (node *DiscoveredNode) String() string {
+	if node.NodeID == nil {
+		return node.Address.String()
+	}
+	return fmt.Sprintf("%s (%s)", node.Address, FormatNodeID(node.NodeID))
+}
+
+func (packet *DiscoveryPacket) Sign(privateKey ed25519.PrivateKey) {
+	packet.Timestamp = time.Unix(0, time.Now().UnixNano())
+	packet.NodeID = privateKey.Public().(ed25519.PublicKey)
+	packet.Signature = ed25519.Sign(privateKey, packet.signedBytes())
+}
+
+func (packet *DiscoveryPacket) Verify() error {
+	if packet.NodeID == nil || packet.Signature == nil {
+		return ErrUnsignedDiscovery
+	}
+	if !ed25519.Verify(packet.NodeID, packet.signedBytes(), packet.Signature) {
+		return ErrInvalidNodeSignature
+	}
+	return nil
+}
+
+func (packet *DiscoveryPacket) signedBytes() []byte {
+	return []byte(strings.Join(packet.headers(), headerSeparator) + headerSeparator + endPacket)
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryPacketSignature(t *testing.T) {
+	identity, err := GenerateNodeIdentity()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	packet := NewResponseDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8400)
+	if packet.Verify() != ErrUnsignedDiscovery {
+		t.Fatal("packet without NODE-ID should not be verified")
+	}
+	packet.Sign(identity)
+	if !packet.NodeID.Equal(identity.Public()) {
+		t.Fatalf("expected NODE-ID %x instead of %x", identity.Public(), packet.NodeID)
+	}
+
+	for _, codec := range []Codec{TextCodec{}, BinaryCodec{}} {
+		packetBytes, err := codec.Encode(&packet)
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		decoded, err := codec.Decode(bytes.NewReader(packetBytes))
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		err = decoded.(*DiscoveryPacket).Verify()
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		if !decoded.(*DiscoveryPacket).Timestamp.Equal(packet.Timestamp) {
+			t.Fatalf("%T: expected signing time %v instead of %v", codec, packet.Timestamp, decoded.(*DiscoveryPacket).Timestamp)
+		}
+	}
+
+	packetString, _ := packet.String()
+	if !strings.Contains(packetString, "NODE-ID: "+FormatNodeID(packet.NodeID)+"\r\nSIGNATURE: ") {
+		t.Fatalf("expected NODE-ID and SIGNATURE headers in\n%s", packetString)
+	}
+	if !strings.Contains(packetString, fmt.Sprintf("TIMESTAMP: %d\r\n", packet.Timestamp.UnixNano())) {
+		t.Fatalf("expected a TIMESTAMP header in\n%s", packetString)
+	}
+	replayed := strings.Replace(packetString, fmt.Sprintf("TIMESTAMP: %d", packet.Timestamp.UnixNano()), fmt.Sprintf("TIMESTAMP: %d", packet.Timestamp.Add(time.Hour).UnixNano()), 1)
+	parsed, err := ParsePacket(bytes.NewBuffer([]byte(replayed)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if parsed.(*DiscoveryPacket).Verify() != ErrInvalidNodeSignature {
+		t.Fatal("packet with a changed TIMESTAMP should not be verified")
+	}
+	spoofed := strings.Replace(packetString, "HOST: 127.0.0.1:8400", "HOST: 127.0.0.1:6666", 1)
+	parsed, err = ParsePacket(bytes.NewBuffer([]byte(spoofed)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if parsed.(*DiscoveryPacket).Verify() != ErrInvalidNodeSignature {
+		t.Fatal("packet with a changed HOST should not be verified")
+	}
+}
+
+func TestLoadNodeIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	identity, err := LoadNodeIdentity(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	loaded, err := LoadNodeIdentity(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !identity.Equal(loaded) {
+		t.Fatal("node identity should persist between loads")
+	}
+}
+
+func TestDiscoveryRejectsImpersonation(t *testing.T) {
+	serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	clientConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clientConn.Close()
+	victim, _ := GenerateNodeIdentity()
+	impostor, _ := GenerateNodeIdentity()
+	serviceSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8416}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serviceNodes := make(chan *DiscoveredNode, 2)
+	go serveDiscovery(ctx, serviceConn, DiscoveryConfig{}, serviceNodes, serviceSocket)
+
+	impersonation := NewRequestDiscoveryPacket(net.IPv4(127, 0, 0, 1), 6666)
+	impersonation.Sign(impostor)
+	impersonation.NodeID = victim.Public().(ed25519.PublicKey)
+	impersonationBytes, _ := impersonation.Bytes()
+	clientConn.WriteTo(impersonationBytes, serviceConn.LocalAddr())
+
+	request := NewRequestDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8417)
+	request.Sign(victim)
+	requestBytes, _ := request.Bytes()
+	clientConn.WriteTo(requestBytes, serviceConn.LocalAddr())
+
+	select {
+	case node := <-serviceNodes:
+		if node.Address.Port != 8417 || !node.NodeID.Equal(victim.Public()) {
+			t.Fatalf("expected only the signed node to be discovered instead of %s", node)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("signed discovery request was not accepted")
+	}
+
+	var response [bufferSize]byte
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	read, _, err := clientConn.ReadFrom(response[:])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	packet, err := ParsePacket(bytes.NewBuffer(response[:read]))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if packet.(*DiscoveryPacket).NodeID != nil {
+		t.Fatal("discovery service without an identity should reply unsigned")
+	}
+}
@@ -0,0 +1,217 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Addresses are listed again at most this often, as DHCP and VPNs change them while a node runs
+const interfaceRefreshInterval = 5 * time.Second
+
+// An address of a local interface, with the network it reaches
+type InterfaceAddress struct {
+	Interface net.Interface
+	Network   *net.IPNet
+}
+
+// Lists the addresses of the interfaces that are up, only of the named ones
+// when names is not empty. IPv6 link-local addresses are skipped, since a HOST
+// header can't carry their zone
+func ListInterfaceAddresses(names []string) (addresses []InterfaceAddress, err error) {
+	var ifaces []net.Interface
+	if len(names) == 0 {
+		ifaces, err = net.Interfaces()
+		if err != nil {
+			return
+		}
+	}
+	for _, name := range names {
+		var iface *net.Interface
+		iface, err = net.InterfaceByName(name)
+		if err != nil {
+			return
+		}
+		ifaces = append(ifaces, *iface)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			network, ok := addr.(*net.IPNet)
+			if !ok || (network.IP.To4() == nil && network.IP.IsLinkLocalUnicast()) {
+				continue
+			}
+			addresses = append(addresses, InterfaceAddress{iface, network})
+		}
+	}
+	return
+}
+
+func (address InterfaceAddress) IP() net.IP {
+	return address.Network.IP
+}
+
+// Directed broadcast address of an IPv4 network, nil when the interface can't broadcast
+func (address InterfaceAddress) Broadcast() net.IP {
+	ip := address.Network.IP.To4()
+	if ip == nil || address.Interface.Flags&net.FlagBroadcast == 0 || len(address.Network.Mask) != net.IPv4len {
+		return nil
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		broadcast[i] = ip[i] | ^address.Network.Mask[i]
+	}
+	return broadcast
+}
+
+type localAddresses struct {
+	names     []string
+	mutex     sync.Mutex
+	listed    time.Time
+	addresses []InterfaceAddress
+}
+
+func newLocalAddresses(names []string) *localAddresses {
+	return &localAddresses{names: names}
+}
+
+func (local *localAddresses) list() []InterfaceAddress {
+	local.mutex.Lock()
+	defer local.mutex.Unlock()
+	if time.Since(local.listed) >= interfaceRefreshInterval {
+		addresses, err := ListInterfaceAddresses(local.names)
+		if err == nil {
+			local.addresses = addresses
+		}
+		local.listed = time.Now()
+	}
+	return local.addresses
+}
+
+// The local address peer reaches this node at. An app bound to a single
+// address is advertised as is, otherwise the address of the interface that
+// reaches peer. Not ok when the interfaces were selected and none of them reaches peer
+func (local *localAddresses) hostFor(appIP net.IP, peer net.IP) (host net.IP, ok bool) {
+	host, ok = local.interfaceFor(peer)
+	if !ok && len(local.names) > 0 {
+		return nil, false
+	}
+	if host == nil || (appIP != nil && !appIP.IsUnspecified()) {
+		return appIP, true
+	}
+	return host, true
+}
+
+// Whether packets from peer arrive through a selected interface, always when none were selected
+func (local *localAddresses) selects(peer net.IP) bool {
+	if len(local.names) == 0 {
+		return true
+	}
+	_, ok := local.interfaceFor(peer)
+	return ok
+}
+
+// The address on the interface sharing a network with peer, or the one the
+// routing table picks to reach it
+func (local *localAddresses) interfaceFor(peer net.IP) (net.IP, bool) {
+	addresses := local.list()
+	for _, address := range addresses {
+		if address.Network.Contains(peer) {
+			return address.IP(), true
+		}
+	}
+	route := routeAddress(peer)
+	if route == nil {
+		return nil, false
+	}
+	if len(local.names) == 0 {
+		return route, true
+	}
+	for _, address := range addresses {
+		if address.IP().Equal(route) {
+			return route, true
+		}
+	}
+	return nil, false
+}
+
+// Connecting a UDP socket sends nothing, but makes the kernel choose the source address for peer
+func routeAddress(peer net.IP) net.IP {
+	conn, err := net.DialUDP(udpNetwork(peer), nil, &net.UDPAddr{IP: peer, Port: 9})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+func (local *localAddresses) isLocal(ip net.IP) bool {
+	for _, address := range local.list() {
+		if address.IP().Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Where a request to dstAddress goes out, and the address advertised in its HOST
+type probeTarget struct {
+	addr  net.Addr
+	host  net.IP
+	iface *net.Interface
+}
+
+// A limited broadcast only leaves through the default interface, so it is sent
+// to the directed broadcast of every interface instead. Multicast requests go
+// out of each selected interface
+func (local *localAddresses) probeTargets(appIP net.IP, dstAddress *net.UDPAddr, multicast bool) (targets []probeTarget) {
+	if appIP != nil && !appIP.IsUnspecified() {
+		return []probeTarget{{dstAddress, appIP, nil}}
+	}
+	switch {
+	case dstAddress.IP.Equal(net.IPv4bcast):
+		for _, address := range local.list() {
+			broadcast := address.Broadcast()
+			if broadcast != nil && address.Interface.Flags&net.FlagLoopback == 0 {
+				targets = append(targets, probeTarget{&net.UDPAddr{IP: broadcast, Port: dstAddress.Port}, address.IP(), nil})
+			}
+		}
+	case multicast && len(local.names) > 0:
+		sent := make(map[int]bool)
+		for _, address := range local.list() {
+			iface := address.Interface
+			if sent[iface.Index] || iface.Flags&net.FlagMulticast == 0 || (address.IP().To4() == nil) != (dstAddress.IP.To4() == nil) {
+				continue
+			}
+			sent[iface.Index] = true
+			targets = append(targets, probeTarget{dstAddress, address.IP(), &iface})
+		}
+	}
+	if len(targets) > 0 {
+		return
+	}
+	host, ok := local.hostFor(appIP, dstAddress.IP)
+	if !ok {
+		host = appIP
+	}
+	return []probeTarget{{dstAddress, host, nil}}
+}
+
+func (target probeTarget) send(conn net.PacketConn, packetBytes []byte) (err error) {
+	udpConn, isUDPConn := conn.(*net.UDPConn)
+	group, isUDPAddr := target.addr.(*net.UDPAddr)
+	if isUDPConn && isUDPAddr && target.iface != nil {
+		err = newMulticastConn(udpConn, group).SetMulticastInterface(target.iface)
+		if err != nil {
+			return
+		}
+	}
+	_, err = conn.WriteTo(packetBytes, target.addr)
+	return
+}
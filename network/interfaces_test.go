@@ -0,0 +1,145 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInterfaceAddressBroadcast(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.1.20/24")
+	address := InterfaceAddress{net.Interface{Flags: net.FlagUp | net.FlagBroadcast}, network}
+	address.Network.IP = net.IPv4(192, 168, 1, 20).To4()
+	if broadcast := address.Broadcast(); !broadcast.Equal(net.IPv4(192, 168, 1, 255)) {
+		t.Fatalf("Expecting broadcast 192.168.1.255 instead of %s", broadcast)
+	}
+	address.Interface.Flags = net.FlagUp
+	if broadcast := address.Broadcast(); broadcast != nil {
+		t.Fatalf("An interface without broadcast should not have a broadcast address, got %s", broadcast)
+	}
+}
+
+func TestListInterfaceAddressesUnknownInterface(t *testing.T) {
+	_, err := ListInterfaceAddresses([]string{"no-such-interface0"})
+	if err == nil {
+		t.Fatal("Listing an unknown interface should fail")
+	}
+}
+
+func TestLocalAddressesHostFor(t *testing.T) {
+	local := newLocalAddresses(nil)
+	host, ok := local.hostFor(net.IPv4zero, net.IPv4(127, 0, 0, 1))
+	if !ok || !host.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("Expecting 127.0.0.1 for a loopback peer instead of %s", host)
+	}
+	appIP := net.IPv4(10, 0, 0, 5)
+	host, ok = local.hostFor(appIP, net.IPv4(127, 0, 0, 1))
+	if !ok || !host.Equal(appIP) {
+		t.Fatalf("An app bound to %s should be advertised as is, got %s", appIP, host)
+	}
+}
+
+func TestDiscoveryServiceAdvertisesInterfaceAddress(t *testing.T) {
+	serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	clientConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clientConn.Close()
+	serviceSocket := &net.TCPAddr{IP: net.IPv4zero, Port: 8426}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveDiscovery(ctx, serviceConn, DiscoveryConfig{}, make(chan *DiscoveredNode, 2), serviceSocket)
+
+	request := NewRequestDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8427)
+	requestBytes, _ := request.Bytes()
+	clientConn.WriteTo(requestBytes, serviceConn.LocalAddr())
+
+	readBuffer := make([]byte, bufferSize)
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	read, _, err := clientConn.ReadFrom(readBuffer)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	packet, err := ParsePacket(bytes.NewBuffer(readBuffer[:read]))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	response, ok := packet.(*DiscoveryPacket)
+	if !ok {
+		t.Fatalf("Expecting a DiscoveryPacket instead of %T", packet)
+	}
+	if !response.Address.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("Expecting the loopback address the peer reaches instead of %s", response.Address)
+	}
+}
+
+func TestDiscoveryServiceIgnoresUnselectedInterfaces(t *testing.T) {
+	var loopback, other string
+	interfaces, _ := net.Interfaces()
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		} else if addresses, _ := ListInterfaceAddresses([]string{iface.Name}); len(addresses) > 0 {
+			other = iface.Name
+		}
+	}
+	if loopback == "" || other == "" {
+		t.Skip("Needs a loopback and another interface that is up")
+	}
+
+	for port, selected := range map[int]string{8436: other, 8438: loopback} {
+		serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		clientConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer clientConn.Close()
+		serviceSocket := &net.TCPAddr{IP: net.IPv4zero, Port: port}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		config := DiscoveryConfig{Interfaces: []string{selected}}
+		discoveredNodes := make(chan *DiscoveredNode, 2)
+		go serveDiscovery(ctx, serviceConn, config, discoveredNodes, serviceSocket)
+
+		request := NewRequestDiscoveryPacket(net.IPv4(127, 0, 0, 1), uint16(port+1))
+		requestBytes, _ := request.Bytes()
+		clientConn.WriteTo(requestBytes, serviceConn.LocalAddr())
+
+		readBuffer := make([]byte, bufferSize)
+		clientConn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, _, err = clientConn.ReadFrom(readBuffer)
+		if selected == loopback {
+			if err != nil {
+				t.Fatalf("A request through the selected %s interface should be answered: %v", selected, err)
+			}
+			select {
+			case <-discoveredNodes:
+			case <-time.After(time.Second):
+				t.Fatalf("A request through the selected %s interface should be discovered", selected)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("A request through %s should not be answered with only %s selected", loopback, selected)
+		}
+		select {
+		case discoveredNode := <-discoveredNodes:
+			t.Fatalf("A request through %s should not be discovered with only %s selected, got %v", loopback, selected, discoveredNode)
+		default:
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package network
+
+type PacketLimits struct {
+	MaxHeaderLines  int
+	MaxHeaderLength int
+	MaxBodySize     int
+}
+
+var DefaultPacketLimits = PacketLimits{
+	MaxHeaderLines:  32,
+	MaxHeaderLength: 512,
+	MaxBodySize:     1 << 20,
+}
+
+// Zero limits fall back to DefaultPacketLimits
+func (limits PacketLimits) orDefault() PacketLimits {
+	if limits.MaxHeaderLines <= 0 {
+		limits.MaxHeaderLines = DefaultPacketLimits.MaxHeaderLines
+	}
+	if limits.MaxHeaderLength <= 0 {
+		limits.MaxHeaderLength = DefaultPacketLimits.MaxHeaderLength
+	}
+	if limits.MaxBodySize <= 0 {
+		limits.MaxBodySize = DefaultPacketLimits.MaxBodySize
+	}
+	return limits
+}
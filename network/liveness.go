@@ -0,0 +1,131 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+type LivenessState uint8
+
+const (
+	LivenessAlive LivenessState = iota
+	LivenessSuspect
+	LivenessDead
+)
+
+var ErrPeerDead = errors.New("peer stopped answering heartbeats")
+
+type LivenessConfig struct {
+	Interval     time.Duration
+	SuspectAfter int
+	DeadAfter    time.Duration
+}
+
+var DefaultLivenessConfig = LivenessConfig{Interval: time.Second, SuspectAfter: 3, DeadAfter: 10 * time.Second}
+
+type Liveness struct {
+	State    LivenessState
+	RTT      time.Duration
+	Missed   int
+	LastSeen time.Time
+}
+
+type Pinger interface {
+	Ping(ctx context.Context) (time.Duration, error)
+}
+
+type LivenessMonitor struct {
+	config   LivenessConfig
+	pinger   Pinger
+	mutex    sync.Mutex
+	liveness Liveness
+}
+
+func (state LivenessState) String() string {
+	switch state {
+	case LivenessAlive:
+		return "ALIVE"
+	case LivenessSuspect:
+		return "SUSPECT"
+	case LivenessDead:
+		return "DEAD"
+	}
+	return "UNKNOWN"
+}
+
+// Fields that are not positive fall back to DefaultLivenessConfig
+func NewLivenessMonitor(pinger Pinger, config LivenessConfig) *LivenessMonitor {
+	if config.Interval <= 0 {
+		config.Interval = DefaultLivenessConfig.Interval
+	}
+	if config.SuspectAfter <= 0 {
+		config.SuspectAfter = DefaultLivenessConfig.SuspectAfter
+	}
+	if config.DeadAfter <= 0 {
+		config.DeadAfter = DefaultLivenessConfig.DeadAfter
+	}
+	return &LivenessMonitor{config: config, pinger: pinger}
+}
+
+func (monitor *LivenessMonitor) Liveness() Liveness {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	return monitor.liveness
+}
+
+// Pings every interval and sends each state change to changes, which may be nil.
+// Returns ErrPeerDead once no PONG arrived within DeadAfter
+func (monitor *LivenessMonitor) Run(ctx context.Context, changes chan Liveness) (err error) {
+	monitor.mutex.Lock()
+	monitor.liveness = Liveness{State: LivenessAlive, LastSeen: time.Now()}
+	monitor.mutex.Unlock()
+
+	ticker := time.NewTicker(monitor.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, monitor.config.Interval)
+		rtt, pingErr := monitor.pinger.Ping(pingCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		liveness, changed := monitor.beat(rtt, pingErr, time.Now())
+		if changed && changes != nil {
+			select {
+			case changes <- liveness:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if liveness.State == LivenessDead {
+			return ErrPeerDead
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (monitor *LivenessMonitor) beat(rtt time.Duration, err error, now time.Time) (liveness Liveness, changed bool) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	previous := monitor.liveness.State
+	if err == nil {
+		monitor.liveness = Liveness{State: LivenessAlive, RTT: rtt, LastSeen: now}
+	} else {
+		monitor.liveness.Missed++
+		switch {
+		case now.Sub(monitor.liveness.LastSeen) >= monitor.config.DeadAfter:
+			monitor.liveness.State = LivenessDead
+		case monitor.liveness.Missed >= monitor.config.SuspectAfter:
+			monitor.liveness.State = LivenessSuspect
+		}
+	}
+	return monitor.liveness, monitor.liveness.State != previous
+}
@@ -0,0 +1,165 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type switchPinger struct {
+	mutex sync.Mutex
+	err   error
+}
+
+func (pinger *switchPinger) Ping(ctx context.Context) (time.Duration, error) {
+	pinger.mutex.Lock()
+	defer pinger.mutex.Unlock()
+	return time.Millisecond, pinger.err
+}
+
+func (pinger *switchPinger) set(err error) {
+	pinger.mutex.Lock()
+	defer pinger.mutex.Unlock()
+	pinger.err = err
+}
+
+func expectLiveness(t *testing.T, changes chan Liveness, state LivenessState) Liveness {
+	select {
+	case liveness := <-changes:
+		if liveness.State != state {
+			t.Fatalf("expected peer to be %s instead of %s", state, liveness.State)
+		}
+		return liveness
+	case <-time.After(time.Second):
+		t.Fatalf("peer was not reported %s", state)
+	}
+	return Liveness{}
+}
+
+func TestLivenessMonitor(t *testing.T) {
+	pinger := &switchPinger{}
+	monitor := NewLivenessMonitor(pinger, LivenessConfig{Interval: 10 * time.Millisecond, SuspectAfter: 2, DeadAfter: 200 * time.Millisecond})
+	changes := make(chan Liveness)
+	result := make(chan error, 1)
+	go func() { result <- monitor.Run(context.Background(), changes) }()
+
+	time.Sleep(30 * time.Millisecond)
+	if liveness := monitor.Liveness(); liveness.State != LivenessAlive || liveness.RTT != time.Millisecond {
+		t.Fatalf("expected alive peer with 1ms RTT instead of %+v", liveness)
+	}
+
+	pinger.set(errors.New("no pong"))
+	liveness := expectLiveness(t, changes, LivenessSuspect)
+	if liveness.Missed != 2 {
+		t.Fatalf("expected peer to be suspect after 2 missed beats instead of %d", liveness.Missed)
+	}
+	pinger.set(nil)
+	expectLiveness(t, changes, LivenessAlive)
+
+	pinger.set(errors.New("no pong"))
+	expectLiveness(t, changes, LivenessSuspect)
+	expectLiveness(t, changes, LivenessDead)
+	if err := <-result; err != ErrPeerDead {
+		t.Fatalf("expected ErrPeerDead instead of %v", err)
+	}
+}
+
+func TestLivenessMonitorNegativeConfig(t *testing.T) {
+	monitor := NewLivenessMonitor(&switchPinger{}, LivenessConfig{Interval: -time.Second, SuspectAfter: -1, DeadAfter: -time.Second})
+	if monitor.config != DefaultLivenessConfig {
+		t.Fatalf("fields that are not positive should fall back to DefaultLivenessConfig instead of %+v", monitor.config)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	monitor.Run(ctx, nil)
+}
+
+func TestActionClientPing(t *testing.T) {
+	for _, codec := range []Codec{TextCodec{}, BinaryCodec{}} {
+		serverConn, clientConn := net.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		go NewActionRouter().ServeConn(ctx, serverConn)
+
+		client := NewActionClient(clientConn, time.Second)
+		client.SetCodec(codec)
+		go client.Serve(clientConn)
+		for i := 0; i < 2; i++ {
+			rtt, err := client.Ping(context.Background())
+			if err != nil {
+				t.Fatalf("%T: %v", codec, err)
+			}
+			if rtt <= 0 {
+				t.Fatalf("%T: expected a positive RTT instead of %s", codec, rtt)
+			}
+		}
+		cancel()
+		clientConn.Close()
+		_, err := client.Ping(context.Background())
+		if err == nil {
+			t.Fatalf("%T: ping over a closed connection should fail", codec)
+		}
+	}
+}
+
+func TestNodeReportsDeadPeer(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8419")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	serverNode := newTestNode(t, multicastGroup, config, nil)
+	err = serverNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer serverNode.Stop()
+
+	events := make(chan PeerEvent, 10)
+	clientNode := newTestNode(t, multicastGroup, config, events)
+	clientNode.config.Liveness = &LivenessConfig{Interval: 20 * time.Millisecond}
+	err = clientNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clientNode.Stop()
+
+	var peer Peer
+	select {
+	case event := <-events:
+		peer = event.Peer
+	case <-time.After(time.Second):
+		t.Fatal("client node did not discover the server node")
+	}
+	time.Sleep(50 * time.Millisecond)
+	liveness, ok := clientNode.Liveness(peer.Address)
+	if !ok || liveness.State != LivenessAlive || liveness.RTT <= 0 {
+		t.Fatalf("expected alive peer with a measured RTT instead of %+v", liveness)
+	}
+
+	//A crashed peer drops the connection without announcing LEAVING
+	clientNode.mutex.Lock()
+	clientNode.connections[peer.Address.String()].conn.Close()
+	clientNode.mutex.Unlock()
+	for {
+		select {
+		case event := <-events:
+			if event.Type != PeerDead {
+				continue
+			}
+			if !event.Peer.NodeID.Equal(peer.NodeID) {
+				t.Fatalf("expected %x to be dead instead of %x", peer.NodeID, event.Peer.NodeID)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatal("dropped server node was not reported dead")
+		}
+	}
+}
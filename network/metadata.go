@@ -0,0 +1,147 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Longest NAME, GAME, LOBBY-ID or LANGUAGE, so a signed announcement with all
+// of them still fits in the datagram a discovery socket reads
+const maxDetailLength = 64
+
+// Optional lobby details a node advertises in discovery, so a server browser
+// can show more than an address. Zero fields are not sent
+type DiscoveryMetadata struct {
+	Name       string `cbor:"1,keyasint,omitempty"`
+	Game       string `cbor:"2,keyasint,omitempty"`
+	LobbyID    string `cbor:"3,keyasint,omitempty"`
+	Players    uint16 `cbor:"4,keyasint,omitempty"`
+	MaxPlayers uint16 `cbor:"5,keyasint,omitempty"`
+	InProgress bool   `cbor:"6,keyasint,omitempty"`
+	Language   string `cbor:"7,keyasint,omitempty"`
+}
+
+func (metadata DiscoveryMetadata) IsZero() bool {
+	return metadata == DiscoveryMetadata{}
+}
+
+// Slots left in the lobby, or -1 when it does not advertise MAX-PLAYERS
+func (metadata DiscoveryMetadata) FreeSlots() int {
+	if metadata.MaxPlayers == 0 {
+		return -1
+	}
+	return int(metadata.MaxPlayers) - int(metadata.Players)
+}
+
+func (metadata DiscoveryMetadata) Validate() error {
+	err := validateDetailHeaders([][2]string{{"NAME", metadata.Name}, {"GAME", metadata.Game}, {"LOBBY-ID", metadata.LobbyID}, {"LANGUAGE", metadata.Language}})
+	if err != nil {
+		return err
+	}
+	if metadata.MaxPlayers > 0 && metadata.Players > metadata.MaxPlayers {
+		return &InvalidHeaderValueError{"PLAYERS", strconv.Itoa(int(metadata.Players)), errors.New("must not be greater than MAX-PLAYERS")}
+	}
+	return nil
+}
+
+func (metadata DiscoveryMetadata) String() string {
+	var fields []string
+	if metadata.Name != "" {
+		fields = append(fields, fmt.Sprintf("%q", metadata.Name))
+	}
+	if metadata.Game != "" {
+		fields = append(fields, "game "+metadata.Game)
+	}
+	if metadata.LobbyID != "" {
+		fields = append(fields, "lobby "+metadata.LobbyID)
+	}
+	if metadata.MaxPlayers > 0 {
+		fields = append(fields, fmt.Sprintf("%d/%d players", metadata.Players, metadata.MaxPlayers))
+	} else if metadata.Players > 0 {
+		fields = append(fields, fmt.Sprintf("%d players", metadata.Players))
+	}
+	if metadata.Language != "" {
+		fields = append(fields, "language "+metadata.Language)
+	}
+	if metadata.InProgress {
+		fields = append(fields, "in progress")
+	}
+	return strings.Join(fields, ", ")
+}
+
+func validateDetailHeaders(headers [][2]string) error {
+	for _, header := range headers {
+		if strings.ContainsAny(header[1], "\r\n") {
+			return &InvalidHeaderValueError{header[0], header[1], errors.New("must not contain line breaks")}
+		}
+		if len(header[1]) > maxDetailLength {
+			return &InvalidHeaderValueError{header[0], header[1], fmt.Errorf("must not be longer than %d bytes", maxDetailLength)}
+		}
+	}
+	return nil
+}
+
+func appendMetadataHeaders(headers []string, metadata DiscoveryMetadata) []string {
+	if metadata.Name != "" {
+		headers = append(headers, fmt.Sprintf("NAME: %s", metadata.Name))
+	}
+	if metadata.Game != "" {
+		headers = append(headers, fmt.Sprintf("GAME: %s", metadata.Game))
+	}
+	if metadata.LobbyID != "" {
+		headers = append(headers, fmt.Sprintf("LOBBY-ID: %s", metadata.LobbyID))
+	}
+	if metadata.Players > 0 {
+		headers = append(headers, fmt.Sprintf("PLAYERS: %d", metadata.Players))
+	}
+	if metadata.MaxPlayers > 0 {
+		headers = append(headers, fmt.Sprintf("MAX-PLAYERS: %d", metadata.MaxPlayers))
+	}
+	if metadata.InProgress {
+		headers = append(headers, "IN-PROGRESS: True")
+	}
+	if metadata.Language != "" {
+		headers = append(headers, fmt.Sprintf("LANGUAGE: %s", metadata.Language))
+	}
+	return headers
+}
+
+func parseMetadataHeaders(headers map[string]string) (metadata DiscoveryMetadata, err error) {
+	metadata.Name = headers["NAME"]
+	metadata.Game = headers["GAME"]
+	metadata.LobbyID = headers["LOBBY-ID"]
+	metadata.Language = headers["LANGUAGE"]
+	metadata.Players, err = parseCountHeader(headers, "PLAYERS")
+	if err != nil {
+		return
+	}
+	metadata.MaxPlayers, err = parseCountHeader(headers, "MAX-PLAYERS")
+	if err != nil {
+		return
+	}
+	if inProgress, ok := headers["IN-PROGRESS"]; ok {
+		switch inProgress {
+		case "True":
+			metadata.InProgress = true
+		case "False":
+			metadata.InProgress = false
+		default:
+			return metadata, &InvalidHeaderValueError{"IN-PROGRESS", inProgress, errors.New("must be True or False")}
+		}
+	}
+	return metadata, metadata.Validate()
+}
+
+func parseCountHeader(headers map[string]string, header string) (uint16, error) {
+	countString, ok := headers[header]
+	if !ok {
+		return 0, nil
+	}
+	count, err := strconv.ParseUint(countString, 10, 16)
+	if err != nil {
+		return 0, &InvalidHeaderValueError{header, countString, err}
+	}
+	return uint16(count), nil
+}
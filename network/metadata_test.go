@@ -0,0 +1,178 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryMetadataHeaders(t *testing.T) {
+	packet := NewResponseDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8400)
+	packet.Metadata = DiscoveryMetadata{Name: "Igor's lobby", Game: "deathmatch", LobbyID: "lobby-1", Players: 3, MaxPlayers: 8, InProgress: true}
+	packetString, err := packet.String()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectedString := "DYLLABLE-DISCOVERY\r\n" +
+		"TYPE: RUNNING-APP\r\n" +
+		"HOST: 127.0.0.1:8400\r\n" +
+		"VERSION: 1\r\n" +
+		"NAME: Igor's lobby\r\n" +
+		"GAME: deathmatch\r\n" +
+		"LOBBY-ID: lobby-1\r\n" +
+		"PLAYERS: 3\r\n" +
+		"MAX-PLAYERS: 8\r\n" +
+		"IN-PROGRESS: True\r\n" +
+		"\r\n"
+	if packetString != expectedString {
+		t.Fatalf("expected packet:\n%#v\ninstead of:\n%#v", expectedString, packetString)
+	}
+
+	parsed, err := ParsePacket(bytes.NewBufferString(packetString))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(parsed.(*DiscoveryPacket).Metadata, packet.Metadata) {
+		t.Fatalf("expected metadata %#v instead of %#v", packet.Metadata, parsed.(*DiscoveryPacket).Metadata)
+	}
+}
+
+func TestSignedDiscoveryMetadata(t *testing.T) {
+	identity, _ := GenerateNodeIdentity()
+	packet := NewResponseDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8400)
+	packet.Metadata = DiscoveryMetadata{Name: "host", Players: 1, MaxPlayers: 2}
+	packet.Sign(identity)
+
+	for _, codec := range []Codec{TextCodec{}, BinaryCodec{}} {
+		packetBytes, err := codec.Encode(&packet)
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		parsed, err := codec.Decode(bytes.NewBuffer(packetBytes))
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		discoveryPacket := parsed.(*DiscoveryPacket)
+		if discoveryPacket.Metadata != packet.Metadata {
+			t.Fatalf("%T: expected metadata %#v instead of %#v", codec, packet.Metadata, discoveryPacket.Metadata)
+		}
+		if err := discoveryPacket.Verify(); err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+
+		//The signature covers the metadata, so a lobby can't be made to look emptier
+		discoveryPacket.Metadata.Players = 0
+		if err := discoveryPacket.Verify(); err != ErrInvalidNodeSignature {
+			t.Fatalf("%T: expected ErrInvalidNodeSignature for tampered metadata instead of %v", codec, err)
+		}
+	}
+}
+
+func TestInvalidDiscoveryMetadata(t *testing.T) {
+	packet := NewResponseDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8400)
+	packet.Metadata.Name = "host\r\nTYPE: DISCOVERY"
+	if _, err := packet.String(); err == nil {
+		t.Fatal("metadata with a line break should not be encoded")
+	}
+	if _, err := MarshalBinaryPacket(&packet); err == nil {
+		t.Fatal("metadata with a line break should not be encoded in binary")
+	}
+
+	invalidHeaders := []string{
+		"PLAYERS: many\r\n",
+		"PLAYERS: 70000\r\n",
+		"PLAYERS: 9\r\nMAX-PLAYERS: 8\r\n",
+		"IN-PROGRESS: yes\r\n",
+	}
+	for _, header := range invalidHeaders {
+		packetString := "DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: RUNNING-APP\r\n" +
+			"HOST: 127.0.0.1:8400\r\n" +
+			header +
+			"\r\n"
+		_, err := ParsePacket(bytes.NewBufferString(packetString))
+		if !errors.Is(err, ErrMalformedPacket) {
+			t.Fatalf("expected ErrMalformedPacket for %q instead of %v", header, err)
+		}
+	}
+}
+
+func TestDiscoveryMetadataFreeSlots(t *testing.T) {
+	if slots := (DiscoveryMetadata{Players: 3}).FreeSlots(); slots != -1 {
+		t.Fatalf("lobby without capacity should have -1 free slots instead of %d", slots)
+	}
+	if slots := (DiscoveryMetadata{Players: 3, MaxPlayers: 8}).FreeSlots(); slots != 5 {
+		t.Fatalf("expected 5 free slots instead of %d", slots)
+	}
+	metadata := DiscoveryMetadata{Name: "host", Players: 3, MaxPlayers: 8, InProgress: true}
+	if !strings.Contains(metadata.String(), "3/8 players") {
+		t.Fatalf("expected the player count in %q", metadata.String())
+	}
+}
+
+func TestLookForNodesReceivesMetadata(t *testing.T) {
+	serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lookupConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	serviceSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8428}
+	lookupSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8429}
+	metadata := DiscoveryMetadata{Name: "host", Game: "coop", LobbyID: "42", Players: 1, MaxPlayers: 4}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serviceNodes := make(chan *DiscoveredNode, 2)
+	lookupNodes := make(chan *DiscoveredNode, 2)
+	go serveDiscovery(ctx, serviceConn, DiscoveryConfig{Metadata: func() DiscoveryMetadata { return metadata }}, serviceNodes, serviceSocket)
+	go lookForNodes(ctx, lookupConn, DiscoveryConfig{}, lookupNodes, serviceConn.LocalAddr().(*net.UDPAddr), lookupSocket, nil)
+
+	select {
+	case node := <-lookupNodes:
+		if node.Metadata != metadata {
+			t.Fatalf("expected metadata %#v instead of %#v", metadata, node.Metadata)
+		}
+		if node.Version != ProtocolVersion {
+			t.Fatalf("expected protocol version %d instead of %d", ProtocolVersion, node.Version)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("LookForNodes did not receive a response")
+	}
+}
+
+func TestLargestDiscoveryMetadataFitsDatagram(t *testing.T) {
+	identity, err := GenerateNodeIdentity()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	field := strings.Repeat("x", maxDetailLength)
+	packet := NewResponseDiscoveryPacket(net.ParseIP("fd00:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), 65535)
+	packet.Metadata = DiscoveryMetadata{Name: field, Game: field, LobbyID: field, Players: 65535, MaxPlayers: 65535, InProgress: true, Language: field}
+	packet.Sign(identity)
+	for _, codec := range []Codec{TextCodec{}, BinaryCodec{}, NewSignedCodec([]byte("secret"))} {
+		packetBytes, err := codec.Encode(&packet)
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		if len(packetBytes) > 1024 {
+			t.Fatalf("%T: the largest announcement takes %d bytes, more than a 1024 bytes datagram", codec, len(packetBytes))
+		}
+	}
+
+	packet.Metadata.Name = field + "x"
+	if _, err := packet.String(); err == nil {
+		t.Fatalf("a NAME longer than %d bytes should not be encoded", maxDetailLength)
+	}
+	query := DiscoveryQuery{LobbyID: field + "x"}
+	if query.Validate() == nil {
+		t.Fatalf("a LOBBY-ID longer than %d bytes should not be queried", maxDetailLength)
+	}
+}
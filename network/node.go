@@ -0,0 +1,641 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peers are forgotten after missing this many discovery intervals
+const peerTTLProbes = 3
+
+// Incompatible nodes are reported once, up to this many of them
+const maxIncompatiblePeers = 256
+const defaultCallTimeout = 10 * time.Second
+
+var ErrNodeStarted = errors.New("node has already been started")
+var ErrNodeStopped = errors.New("node is not running")
+
+// The codec and identity of Discovery are also the ones of calls and sessions with other nodes
+type NodeConfig struct {
+	AppSocket       *net.TCPAddr
+	DiscoverySocket *net.UDPAddr
+	LookupAddress   *net.UDPAddr
+	PeerTTL         time.Duration
+	CallTimeout     time.Duration
+	Encrypted       bool
+	Liveness        *LivenessConfig
+	Reconnect       *ReconnectConfig
+	PeerEvents      chan PeerEvent
+	Discovery       DiscoveryConfig
+	//NODE-IDs accepted for sessions without being discovered, such as tools that never announce themselves
+	Trusted []ed25519.PublicKey
+}
+
+type Node struct {
+	Router       *ActionRouter
+	config       NodeConfig
+	mutex        sync.Mutex
+	started      bool
+	ctx          context.Context
+	cancel       context.CancelFunc
+	appSocket    *net.TCPAddr
+	registry     *PeerRegistry
+	workers      sync.WaitGroup
+	calls        sync.WaitGroup
+	connections  map[string]*peerConnection
+	serving      sync.WaitGroup
+	liveness     chan PeerEvent
+	probes       chan struct{}
+	reconnecting map[string]chan struct{}
+	dialing      map[string]bool
+	incompatible map[string]bool
+}
+
+type peerConnection struct {
+	conn    net.Conn
+	client  *ActionClient
+	monitor *LivenessMonitor
+	done    chan struct{}
+}
+
+func NewNode(config NodeConfig, router *ActionRouter) *Node {
+	if config.PeerTTL == 0 {
+		config.PeerTTL = peerTTLProbes * config.Discovery.orDefault().ProbeInterval
+	}
+	if config.CallTimeout == 0 {
+		config.CallTimeout = defaultCallTimeout
+	}
+	if config.LookupAddress == nil {
+		config.LookupAddress = config.DiscoverySocket
+	}
+	if config.Discovery.Codec == nil {
+		config.Discovery.Codec = DefaultCodec
+	}
+	if router == nil {
+		router = NewActionRouter()
+	}
+	router.SetCodec(config.Discovery.Codec)
+	//Callers give up on an action after their own call timeout, so draining one longer is pointless
+	router.SetDrainTimeout(config.CallTimeout)
+	replayWindow := DefaultReconnectConfig.ReplayWindow
+	if config.Reconnect != nil {
+		reconnect := config.Reconnect.orDefault()
+		config.Reconnect = &reconnect
+		replayWindow = reconnect.ReplayWindow
+	}
+	//Callers replay requests whether or not this node redials its own peers
+	router.Use(ReplayMiddleware(replayWindow))
+	return &Node{Router: router, config: config, connections: make(map[string]*peerConnection), reconnecting: make(map[string]chan struct{}), dialing: make(map[string]bool), incompatible: make(map[string]bool)}
+}
+
+func (node *Node) Start(ctx context.Context) (err error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.started {
+		return ErrNodeStarted
+	}
+	err = node.config.Discovery.metadata().Validate()
+	if err == nil {
+		err = node.config.Discovery.Query.Validate()
+	}
+	if err == nil && len(node.config.Discovery.Interfaces) > 0 {
+		_, err = ListInterfaceAddresses(node.config.Discovery.Interfaces)
+	}
+	if err != nil {
+		return
+	}
+
+	listener, err := net.ListenTCP(tcpNetwork(node.config.AppSocket.IP), node.config.AppSocket)
+	if err != nil {
+		return
+	}
+	serviceConn, lookupConn, err := node.listenDiscovery()
+	if err != nil {
+		listener.Close()
+		return
+	}
+	if node.config.Discovery.Identity == nil {
+		node.config.Discovery.Identity, err = GenerateNodeIdentity()
+		if err != nil {
+			listener.Close()
+			serviceConn.Close()
+			lookupConn.Close()
+			return
+		}
+	}
+	var actionListener net.Listener = listener
+	if node.config.Encrypted {
+		var sessionConfig *tls.Config
+		sessionConfig, err = NewSessionTLSConfig(node.config.Discovery.Identity, nil)
+		if err != nil {
+			listener.Close()
+			serviceConn.Close()
+			lookupConn.Close()
+			return
+		}
+		sessionConfig.VerifyPeerCertificate = node.verifyPeerCertificate
+		actionListener = tls.NewListener(listener, sessionConfig)
+	}
+	node.appSocket = listener.Addr().(*net.TCPAddr)
+	node.started = true
+
+	ctx, node.cancel = context.WithCancel(ctx)
+	node.ctx = ctx
+	node.liveness = make(chan PeerEvent)
+	node.probes = make(chan struct{}, 1)
+	serviceNodes := make(chan *DiscoveredNode)
+	lookupNodes := make(chan *DiscoveredNode)
+	discoveredNodes := make(chan *DiscoveredNode)
+	events := make(chan PeerEvent)
+	node.registry = NewPeerRegistry(node.config.PeerTTL, events)
+	discovery := node.discoveryConfig()
+
+	node.run(func() { node.Router.Serve(ctx, actionListener) })
+	node.run(func() {
+		serveDiscovery(ctx, serviceConn, discovery, serviceNodes, node.appSocket)
+	})
+	node.run(func() {
+		lookForNodes(ctx, lookupConn, discovery, lookupNodes, node.config.LookupAddress, node.appSocket, node.probes)
+	})
+	node.run(func() { node.mergeDiscoveredNodes(ctx, discoveredNodes, serviceNodes, lookupNodes) })
+	node.run(func() { node.registry.Run(ctx, discoveredNodes) })
+	node.run(func() { node.handlePeerEvents(ctx, events) })
+	return
+}
+
+func (node *Node) Stop() error {
+	node.mutex.Lock()
+	if node.cancel == nil {
+		node.mutex.Unlock()
+		return ErrNodeStopped
+	}
+	node.cancel()
+	node.cancel = nil
+	node.mutex.Unlock()
+
+	node.workers.Wait()
+	node.calls.Wait()
+
+	node.mutex.Lock()
+	for key, connection := range node.connections {
+		connection.conn.Close()
+		delete(node.connections, key)
+	}
+	node.mutex.Unlock()
+	node.serving.Wait()
+	return nil
+}
+
+func (node *Node) NodeID() ed25519.PublicKey {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.config.Discovery.Identity == nil {
+		return nil
+	}
+	return node.config.Discovery.Identity.Public().(ed25519.PublicKey)
+}
+
+func (node *Node) AppSocket() *net.TCPAddr {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.appSocket
+}
+
+func (node *Node) Metadata() DiscoveryMetadata {
+	node.mutex.Lock()
+	discovery := node.config.Discovery
+	node.mutex.Unlock()
+	return discovery.metadata()
+}
+
+// Changes what the node advertises from its next discovery packet on, as players join or the game starts
+func (node *Node) SetMetadata(metadata DiscoveryMetadata) error {
+	err := metadata.Validate()
+	if err != nil {
+		return err
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.config.Discovery.Metadata = func() DiscoveryMetadata { return metadata }
+	return nil
+}
+
+func (node *Node) Peers() []Peer {
+	node.mutex.Lock()
+	registry := node.registry
+	node.mutex.Unlock()
+	if registry == nil {
+		return nil
+	}
+	return registry.Peers()
+}
+
+// Heartbeat state of the connection to peer, only tracked when NodeConfig.Liveness is set
+func (node *Node) Liveness(peer *net.TCPAddr) (Liveness, bool) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	connection, ok := node.connections[peer.String()]
+	if !ok || connection.monitor == nil {
+		return Liveness{}, false
+	}
+	return connection.monitor.Liveness(), true
+}
+
+func (node *Node) Call(ctx context.Context, peer *net.TCPAddr, actionId uint8, parameters map[string]interface{}) (*ResponseActionPacket, error) {
+	node.mutex.Lock()
+	if node.cancel == nil {
+		node.mutex.Unlock()
+		return nil, ErrNodeStopped
+	}
+	node.calls.Add(1)
+	node.mutex.Unlock()
+	defer node.calls.Done()
+
+	request := NewRequestActionPacket(actionId, parameters)
+	//Peers are spoken to in the version agreed on through discovery
+	if version := node.knownPeer(peer).Version; version != 0 {
+		request.Version = version
+	}
+	for {
+		err := node.awaitReconnect(ctx, peer)
+		if err != nil {
+			return nil, err
+		}
+		connection, err := node.connect(ctx, peer)
+		if err != nil {
+			return nil, err
+		}
+		response, err := connection.client.Send(ctx, &request)
+		if err == nil || !node.replayable(ctx, connection, err) {
+			return response, err
+		}
+		//A write that broke the stream leaves the connection to be closed here rather than by its reader
+		connection.conn.Close()
+		select {
+		case <-connection.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (node *Node) listenDiscovery() (serviceConn *net.UDPConn, lookupConn *net.UDPConn, err error) {
+	config := DiscoveryConfig{Multicast: node.config.Discovery.Multicast, Interfaces: node.config.Discovery.Interfaces}
+	serviceConn, err = listenDiscovery(node.config.DiscoverySocket, config)
+	if err != nil {
+		return
+	}
+	lookupConn, err = dialDiscovery(node.config.LookupAddress, config)
+	if err != nil {
+		serviceConn.Close()
+	}
+	return
+}
+
+// NodeConfig.Discovery as given, reading the metadata SetMetadata changes and
+// reporting incompatible nodes as peer events as well
+func (node *Node) discoveryConfig() DiscoveryConfig {
+	config := node.config.Discovery
+	config.Metadata = node.Metadata
+	incompatible := config.Incompatible
+	config.Incompatible = func(discoveredNode *DiscoveredNode, err error) {
+		if incompatible != nil {
+			incompatible(discoveredNode, err)
+		}
+		node.reportIncompatible(discoveredNode, err)
+	}
+	return config
+}
+
+func (node *Node) reportIncompatible(discoveredNode *DiscoveredNode, err error) {
+	key := discoveredNode.Address.String()
+	node.mutex.Lock()
+	reported := node.incompatible[key] || len(node.incompatible) >= maxIncompatiblePeers
+	if !reported {
+		node.incompatible[key] = true
+	}
+	node.mutex.Unlock()
+	if reported {
+		return
+	}
+	peer := Peer{Address: discoveredNode.Address, NodeID: discoveredNode.NodeID, Metadata: discoveredNode.Metadata}
+	//Discovery keeps reading while the event waits for the peer event loop
+	node.run(func() { node.emitLiveness(PeerEvent{PeerIncompatible, peer, err}) })
+}
+
+func (node *Node) run(worker func()) {
+	node.workers.Add(1)
+	go func() {
+		defer node.workers.Done()
+		worker()
+	}()
+}
+
+func (node *Node) handlePeerEvents(ctx context.Context, events chan PeerEvent) {
+	for {
+		var event PeerEvent
+		select {
+		case registryEvent, ok := <-events:
+			if !ok {
+				if node.config.PeerEvents != nil {
+					close(node.config.PeerEvents)
+				}
+				return
+			}
+			event = registryEvent
+		case event = <-node.liveness:
+		}
+		switch event.Type {
+		case PeerJoined:
+			node.connectInBackground(ctx, event.Peer.Address)
+		case PeerLeft:
+			node.disconnect(event.Peer.Address)
+		case PeerDead:
+			node.drop(event.Peer.Address)
+		}
+		if node.config.PeerEvents != nil {
+			select {
+			case node.config.PeerEvents <- event:
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+func (node *Node) connect(ctx context.Context, peer *net.TCPAddr) (*peerConnection, error) {
+	node.mutex.Lock()
+	connection, ok := node.connections[peer.String()]
+	node.mutex.Unlock()
+	if ok {
+		return connection, nil
+	}
+
+	conn, err := node.dial(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.attach(peer, conn), nil
+}
+
+// A peer that can't be reached must not hold up the events after it, so
+// joined peers are dialed aside, one dial per peer at a time
+func (node *Node) connectInBackground(ctx context.Context, peer *net.TCPAddr) {
+	key := peer.String()
+	node.mutex.Lock()
+	_, connected := node.connections[key]
+	if connected || node.dialing[key] {
+		node.mutex.Unlock()
+		return
+	}
+	node.dialing[key] = true
+	node.mutex.Unlock()
+	node.run(func() {
+		node.connect(ctx, peer)
+		node.mutex.Lock()
+		delete(node.dialing, key)
+		node.mutex.Unlock()
+	})
+}
+
+func (node *Node) attach(peer *net.TCPAddr, conn net.Conn) *peerConnection {
+	key := peer.String()
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if existing, ok := node.connections[key]; ok {
+		conn.Close()
+		return existing
+	}
+	connection := &peerConnection{conn: conn, client: NewActionClient(conn, node.config.CallTimeout), done: make(chan struct{})}
+	connection.client.SetCodec(node.config.Discovery.Codec)
+	node.connections[key] = connection
+	monitorCtx, stopMonitor := context.WithCancel(node.ctx)
+	if node.config.Liveness != nil {
+		connection.monitor = NewLivenessMonitor(connection.client, *node.config.Liveness)
+		node.serving.Add(1)
+		go func() {
+			defer node.serving.Done()
+			node.monitorPeer(monitorCtx, peer, connection.monitor)
+		}()
+	}
+	node.serving.Add(1)
+	go func() {
+		defer node.serving.Done()
+		connection.client.Serve(conn)
+		stopMonitor()
+		conn.Close()
+		node.mutex.Lock()
+		dropped := node.connections[key] == connection
+		if dropped {
+			delete(node.connections, key)
+		}
+		var reconnected chan struct{}
+		if dropped && node.config.Reconnect != nil && node.ctx.Err() == nil {
+			reconnected = make(chan struct{})
+			node.reconnecting[key] = reconnected
+		}
+		node.mutex.Unlock()
+		close(connection.done)
+		//A connection closed by the peer rather than by disconnect is a drop heartbeats don't need to wait for
+		if dropped && connection.monitor != nil && connection.monitor.Liveness().State != LivenessDead {
+			node.emitLiveness(PeerEvent{PeerDead, node.knownPeer(peer), nil})
+		}
+		if reconnected != nil {
+			node.reconnect(peer, reconnected, connection.monitor != nil)
+		}
+	}()
+	return connection
+}
+
+// Redials a dropped peer until it answers again or discovery stops seeing it
+func (node *Node) reconnect(peer *net.TCPAddr, reconnected chan struct{}, reportRecovery bool) {
+	defer func() {
+		node.mutex.Lock()
+		delete(node.reconnecting, peer.String())
+		node.mutex.Unlock()
+		close(reconnected)
+	}()
+	select {
+	case node.probes <- struct{}{}:
+	default:
+	}
+	for attempt := 0; ; attempt++ {
+		timer := time.NewTimer(node.config.Reconnect.Backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-node.ctx.Done():
+			timer.Stop()
+			return
+		}
+		if node.knownPeer(peer).LastSeen.IsZero() {
+			return
+		}
+		conn, err := node.dial(node.ctx, peer)
+		if err != nil {
+			continue
+		}
+		node.attach(peer, conn)
+		if reportRecovery {
+			node.emitLiveness(PeerEvent{PeerRecovered, node.knownPeer(peer), nil})
+		}
+		return
+	}
+}
+
+func (node *Node) awaitReconnect(ctx context.Context, peer *net.TCPAddr) error {
+	node.mutex.Lock()
+	reconnected := node.reconnecting[peer.String()]
+	node.mutex.Unlock()
+	if reconnected == nil {
+		return nil
+	}
+	select {
+	case <-reconnected:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Requests that failed with their connection may not have reached the peer, so they are sent again.
+// Any other error, such as parameters the codec can't encode, would fail the same way again
+func (node *Node) replayable(ctx context.Context, connection *peerConnection, err error) bool {
+	return node.config.Reconnect != nil && ctx.Err() == nil && node.ctx.Err() == nil && connection.client.isClosed()
+}
+
+func (node *Node) dial(ctx context.Context, peer *net.TCPAddr) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: node.config.CallTimeout}
+	if !node.config.Encrypted {
+		return dialer.DialContext(ctx, "tcp", peer.String())
+	}
+	nodeID := node.knownPeer(peer).NodeID
+	if nodeID == nil {
+		return nil, ErrUnknownPeerIdentity
+	}
+	sessionConfig, err := NewSessionTLSConfig(node.config.Discovery.Identity, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	tlsDialer := tls.Dialer{NetDialer: &dialer, Config: sessionConfig}
+	return tlsDialer.DialContext(ctx, "tcp", peer.String())
+}
+
+// Sessions are only accepted from nodes whose NODE-ID discovery has verified, or that are trusted
+func (node *Node) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	nodeID, err := verifyNodeCertificate(rawCerts)
+	if err != nil {
+		return err
+	}
+	for _, trusted := range node.config.Trusted {
+		if trusted.Equal(nodeID) {
+			return nil
+		}
+	}
+	node.mutex.Lock()
+	registry := node.registry
+	node.mutex.Unlock()
+	if registry == nil || !registry.hasNodeID(nodeID) {
+		return ErrUndiscoveredPeer
+	}
+	return nil
+}
+
+func (node *Node) knownPeer(address *net.TCPAddr) Peer {
+	for _, peer := range node.Peers() {
+		if peer.Address.String() == address.String() {
+			return peer
+		}
+	}
+	return Peer{Address: address}
+}
+
+func (node *Node) monitorPeer(ctx context.Context, peer *net.TCPAddr, monitor *LivenessMonitor) {
+	changes := make(chan Liveness)
+	go func() {
+		monitor.Run(ctx, changes)
+		close(changes)
+	}()
+	for liveness := range changes {
+		event := PeerEvent{PeerRecovered, node.knownPeer(peer), nil}
+		switch liveness.State {
+		case LivenessSuspect:
+			event.Type = PeerSuspected
+		case LivenessDead:
+			event.Type = PeerDead
+		}
+		select {
+		case node.liveness <- event:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (node *Node) emitLiveness(event PeerEvent) {
+	select {
+	case node.liveness <- event:
+	case <-node.ctx.Done():
+	}
+}
+
+// Closes a connection whose heartbeats stopped, leaving it to be redialed like any other drop
+func (node *Node) drop(peer *net.TCPAddr) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	connection, ok := node.connections[peer.String()]
+	if ok && connection.monitor != nil && connection.monitor.Liveness().State == LivenessDead {
+		connection.conn.Close()
+	}
+}
+
+func (node *Node) disconnect(peer *net.TCPAddr) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	connection, ok := node.connections[peer.String()]
+	if ok {
+		connection.conn.Close()
+		delete(node.connections, peer.String())
+	}
+}
+
+func (node *Node) mergeDiscoveredNodes(ctx context.Context, discoveredNodes chan *DiscoveredNode, sources ...chan *DiscoveredNode) {
+	nodeID := node.config.Discovery.Identity.Public().(ed25519.PublicKey)
+	//A request says nothing about the lobby of its sender, so with a query only matching replies admit peers
+	filtered := !node.config.Discovery.Query.IsZero()
+	var merging sync.WaitGroup
+	for _, source := range sources {
+		merging.Add(1)
+		go func(source chan *DiscoveredNode) {
+			defer merging.Done()
+			for discoveredNode := range source {
+				if discoveredNode.Address.String() == node.appSocket.String() || nodeID.Equal(discoveredNode.NodeID) {
+					continue
+				}
+				if filtered && discoveredNode.Requesting {
+					continue
+				}
+				select {
+				case discoveredNodes <- discoveredNode:
+				case <-ctx.Done():
+				}
+			}
+		}(source)
+	}
+	merging.Wait()
+	close(discoveredNodes)
+}
+
+func tcpNetwork(ip net.IP) string {
+	switch {
+	case ip == nil || ip.Equal(net.IPv6unspecified):
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
@@ -0,0 +1,457 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T, multicastGroup *net.UDPAddr, config MulticastConfig, events chan PeerEvent) *Node {
+	appSocket, err := net.ResolveTCPAddr("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return NewNode(NodeConfig{
+		AppSocket:       appSocket,
+		DiscoverySocket: multicastGroup,
+		PeerTTL:         time.Second,
+		CallTimeout:     time.Second,
+		PeerEvents:      events,
+		Discovery:       DiscoveryConfig{Multicast: &config},
+	}, nil)
+}
+
+func TestNodeDiscoversAndCallsPeer(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8410")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	serverNode := newTestNode(t, multicastGroup, config, nil)
+	serverNode.Router.Handle(1, echoHandler)
+	err = serverNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer serverNode.Stop()
+
+	events := make(chan PeerEvent, 10)
+	clientNode := newTestNode(t, multicastGroup, config, events)
+	err = clientNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var event PeerEvent
+	select {
+	case event = <-events:
+	case <-time.After(time.Second):
+		t.Fatal("client node did not discover the server node")
+	}
+	if event.Type != PeerJoined || event.Peer.Address.String() != serverNode.AppSocket().String() {
+		t.Fatalf("expected %s to join instead of %s %s", serverNode.AppSocket(), event.Type, event.Peer.Address)
+	}
+	if !event.Peer.NodeID.Equal(serverNode.NodeID()) {
+		t.Fatalf("expected peer NODE-ID %x instead of %x", serverNode.NodeID(), event.Peer.NodeID)
+	}
+	for _, peer := range clientNode.Peers() {
+		if peer.Address.String() == clientNode.AppSocket().String() {
+			t.Fatal("node should not discover itself")
+		}
+	}
+
+	response, err := clientNode.Call(context.Background(), event.Peer.Address, 1, map[string]interface{}{"key": "value"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !response.Approved || response.Content["key"] != "value" {
+		t.Fatalf("unexpected response %v", response.Content)
+	}
+
+	err = clientNode.Stop()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for range events {
+	}
+	_, err = clientNode.Call(context.Background(), event.Peer.Address, 1, nil)
+	if err != ErrNodeStopped {
+		t.Fatalf("expected ErrNodeStopped instead of %v", err)
+	}
+	if clientNode.Start(context.Background()) != ErrNodeStarted {
+		t.Fatal("stopped node should not be started again")
+	}
+}
+
+func TestNodeStopDrainsInFlightActions(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8411")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	serverNode := newTestNode(t, multicastGroup, config, nil)
+	started := make(chan struct{})
+	serverNode.Router.Handle(1, func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+		close(started)
+		select {
+		case <-time.After(200 * time.Millisecond):
+			return NewResponseActionPacket(request.RequestUUID, true, nil)
+		case <-ctx.Done():
+			return NewErrorResponseActionPacket(request.RequestUUID, ctx.Err())
+		}
+	})
+	err = serverNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	conn, err := net.Dial("tcp", serverNode.AppSocket().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	client := NewActionClient(conn, time.Second)
+	go client.Serve(conn)
+
+	result := make(chan error, 1)
+	go func() {
+		response, err := client.Call(context.Background(), 1, nil)
+		if err == nil && !response.Approved {
+			t.Errorf("expected in-flight action to be approved")
+		}
+		result <- err
+	}()
+
+	<-started
+	err = serverNode.Stop()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = <-result
+	if err != nil {
+		t.Fatalf("in-flight action should complete during shutdown: %v", err)
+	}
+}
+
+func TestNodeStopCancelsActionsAfterDrainTimeout(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8442")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	serverNode := newTestNode(t, multicastGroup, config, nil)
+	serverNode.config.CallTimeout = 100 * time.Millisecond
+	serverNode = NewNode(serverNode.config, nil)
+	started := make(chan struct{})
+	serverNode.Router.Handle(1, func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+		close(started)
+		<-ctx.Done()
+		return NewErrorResponseActionPacket(request.RequestUUID, ctx.Err())
+	})
+	err = serverNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	conn, err := net.Dial("tcp", serverNode.AppSocket().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	client := NewActionClient(conn, time.Second)
+	go client.Serve(conn)
+	go client.Call(context.Background(), 1, nil)
+
+	<-started
+	stopped := make(chan error, 1)
+	go func() { stopped <- serverNode.Stop() }()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("an action still running after the drain timeout should be cancelled")
+	}
+}
+
+func TestNodeStopAnnouncesLeaving(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8423")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	serverNode := newTestNode(t, multicastGroup, config, nil)
+	err = serverNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	events := make(chan PeerEvent, 10)
+	clientNode := newTestNode(t, multicastGroup, config, events)
+	clientNode.config.PeerTTL = time.Minute
+	err = clientNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clientNode.Stop()
+
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("client node did not discover the server node")
+	}
+	serverNode.Stop()
+	for {
+		select {
+		case event := <-events:
+			if event.Type != PeerLeft {
+				continue
+			}
+			if !event.Peer.NodeID.Equal(serverNode.NodeID()) {
+				t.Fatalf("expected %x to leave instead of %x", serverNode.NodeID(), event.Peer.NodeID)
+			}
+			if len(clientNode.Peers()) != 0 {
+				t.Fatal("leaving node should be removed from the peers")
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatal("stopped node was not removed before its PeerTTL")
+		}
+	}
+}
+
+func TestNodeDialsJoinedPeersAside(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8428")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	//Accepts connections but never answers the TLS handshake
+	stalling, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer stalling.Close()
+	go func() {
+		for {
+			conn, err := stalling.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	events := make(chan PeerEvent, 10)
+	node := newTestNode(t, multicastGroup, config, events)
+	node.config.Encrypted = true
+	node.config.CallTimeout = 5 * time.Second
+	err = node.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer node.Stop()
+
+	identity, err := GenerateNodeIdentity()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	stallingPeer := Peer{Address: stalling.Addr().(*net.TCPAddr), NodeID: identity.Public().(ed25519.PublicKey)}
+	node.registry.observe(&DiscoveredNode{Address: stallingPeer.Address, NodeID: stallingPeer.NodeID}, time.Now())
+	otherPeer := Peer{Address: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6666}}
+	node.emitLiveness(PeerEvent{PeerJoined, stallingPeer, nil})
+	node.emitLiveness(PeerEvent{PeerJoined, stallingPeer, nil})
+	node.emitLiveness(PeerEvent{PeerLeft, otherPeer, nil})
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-events:
+		case <-time.After(time.Second):
+			t.Fatal("an unreachable peer should not hold up the events after it")
+		}
+	}
+	node.mutex.Lock()
+	dialing := len(node.dialing)
+	node.mutex.Unlock()
+	if dialing != 1 {
+		t.Fatalf("expected a single dial to the unreachable peer instead of %d", dialing)
+	}
+}
+
+func TestNodeReportsIncompatiblePeer(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8430")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	events := make(chan PeerEvent, 10)
+	node := newTestNode(t, multicastGroup, config, events)
+	err = node.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer node.Stop()
+
+	conn, err := dialMulticastGroup(multicastGroup, config)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	futurePacket := NewRequestDiscoveryPacket(net.IPv4(10, 0, 10, 2), 8409)
+	futurePacket.Version = ProtocolVersion + 2
+	futurePacket.MinVersion = ProtocolVersion + 1
+	futurePacketBytes, _ := futurePacket.Bytes()
+	for i := 0; i < 2; i++ {
+		conn.WriteTo(futurePacketBytes, multicastGroup)
+	}
+
+	select {
+	case event := <-events:
+		var versionErr *IncompatibleVersionError
+		if event.Type != PeerIncompatible || !errors.As(event.Err, &versionErr) {
+			t.Fatalf("expected an incompatible peer instead of %s %v", event.Type, event.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("node did not report the incompatible peer")
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("an incompatible peer should be reported once, got %s", event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNodeQueryAdmitsOnlyMatchingPeers(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8434")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	otherLobby := newTestNode(t, multicastGroup, config, nil)
+	otherLobby.SetMetadata(DiscoveryMetadata{LobbyID: "xyz"})
+	otherLobby.config.Discovery.BurstInterval = 50 * time.Millisecond
+	otherLobby.config.Discovery.BurstProbes = 10
+	friendLobby := newTestNode(t, multicastGroup, config, nil)
+	friendLobby.SetMetadata(DiscoveryMetadata{LobbyID: "abc"})
+	for _, lobby := range []*Node{otherLobby, friendLobby} {
+		err = lobby.Start(context.Background())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer lobby.Stop()
+	}
+
+	events := make(chan PeerEvent, 10)
+	node := newTestNode(t, multicastGroup, config, events)
+	node.config.Discovery.Query = DiscoveryQuery{LobbyID: "abc"}
+	err = node.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer node.Stop()
+
+	timeout := time.After(time.Second)
+	joined := false
+	for {
+		select {
+		case event := <-events:
+			if event.Peer.Address.String() != friendLobby.AppSocket().String() {
+				t.Fatalf("a node querying lobby abc should only see its lobby, got %s %s", event.Type, event.Peer.Metadata)
+			}
+			joined = joined || event.Type == PeerJoined
+		case <-timeout:
+			if !joined {
+				t.Fatal("node did not discover the lobby it queried")
+			}
+			return
+		}
+	}
+}
+
+func TestNodeUsesDiscoveryConfig(t *testing.T) {
+	identity, _ := GenerateNodeIdentity()
+	metadata := DiscoveryMetadata{LobbyID: "abc"}
+	reported := make(chan error, 1)
+	events := make(chan PeerEvent, 1)
+	node := NewNode(NodeConfig{
+		AppSocket:       &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		DiscoverySocket: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8435},
+		PeerEvents:      events,
+		Discovery: DiscoveryConfig{
+			Codec:        BinaryCodec{},
+			Identity:     identity,
+			Metadata:     func() DiscoveryMetadata { return metadata },
+			Incompatible: func(node *DiscoveredNode, err error) { reported <- err },
+		},
+	}, nil)
+	err := node.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer node.Stop()
+
+	if !node.NodeID().Equal(identity.Public().(ed25519.PublicKey)) {
+		t.Fatal("the node should use the identity of its discovery config")
+	}
+	if _, ok := node.Router.codec.(BinaryCodec); !ok {
+		t.Fatalf("calls should use the codec of the discovery config instead of %T", node.Router.codec)
+	}
+	if node.Metadata() != metadata {
+		t.Fatalf("expected the metadata of the discovery config instead of %s", node.Metadata())
+	}
+
+	incompatibleErr := &IncompatibleVersionError{ProtocolVersion + 2, ProtocolVersion + 1}
+	node.discoveryConfig().Incompatible(&DiscoveredNode{Address: &net.TCPAddr{IP: net.IPv4(10, 0, 10, 2), Port: 8409}}, incompatibleErr)
+	select {
+	case err := <-reported:
+		if err != incompatibleErr {
+			t.Fatalf("expected %v to be reported instead of %v", incompatibleErr, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the Incompatible callback of the discovery config should be called")
+	}
+	select {
+	case event := <-events:
+		if event.Type != PeerIncompatible {
+			t.Fatalf("expected an incompatible peer instead of %s", event.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("node should still report the incompatible peer")
+	}
+}
@@ -2,6 +2,8 @@ package network
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +11,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -22,26 +25,68 @@ const endPacket = "\r\n"
 
 const requestDiscoveryType = "DISCOVERY"
 const responseDiscoveryType = "RUNNING-APP"
+const leavingDiscoveryType = "LEAVING"
 
 const requestActionIdentifier = actionPreffix + "REQUEST"
 const responseActionIdentifier = actionPreffix + "RESPONSE"
 
+const heartbeatIdentifier = preffix + "HEARTBEAT"
+const pingHeartbeatType = "PING"
+const pongHeartbeatType = "PONG"
+
 type Packet interface {
 	String() (string, error)
 	Bytes() ([]byte, error)
 }
 
 type DiscoveryPacket struct {
-	Address net.IP
-	Port    uint16
-	Type    string
+	Address    net.IP
+	Port       uint16
+	Type       string
+	Version    uint8
+	MinVersion uint8
+	NodeID     ed25519.PublicKey
+	Signature  []byte
+	Metadata   DiscoveryMetadata
+	Query      DiscoveryQuery
+	//When the packet was signed, so an old announcement can't be passed off as a new one
+	Timestamp time.Time
 }
 
 func (packet *DiscoveryPacket) String() (string, error) {
+	err := packet.Metadata.Validate()
+	if err == nil {
+		err = packet.Query.Validate()
+	}
+	if err != nil {
+		return "", err
+	}
+	headers := packet.headers()
+	if packet.Signature != nil {
+		headers = append(headers, fmt.Sprintf("SIGNATURE: %s", hex.EncodeToString(packet.Signature)))
+	}
+	return strings.Join(headers, headerSeparator) + headerSeparator + endPacket, nil
+}
+
+// Every header but SIGNATURE, which is computed over them
+func (packet *DiscoveryPacket) headers() []string {
 	typeHeader := fmt.Sprintf("TYPE: %s", packet.Type)
-	hostHeader := fmt.Sprintf("HOST: %s:%d", packet.Address, packet.Port)
+	hostHeader := fmt.Sprintf("HOST: %s", net.JoinHostPort(packet.Address.String(), strconv.Itoa(int(packet.Port))))
 	headers := []string{discoveryIdentifier, typeHeader, hostHeader}
-	return strings.Join(headers, headerSeparator) + headerSeparator + endPacket, nil
+	headers = appendVersionHeaders(headers, packet.Version, packet.MinVersion)
+	//A request names what it looks for with the headers a lobby is described by
+	if packet.Type == requestDiscoveryType {
+		headers = appendQueryHeaders(headers, packet.Query)
+	} else {
+		headers = appendMetadataHeaders(headers, packet.Metadata)
+	}
+	if !packet.Timestamp.IsZero() {
+		headers = append(headers, fmt.Sprintf("TIMESTAMP: %d", packet.Timestamp.UnixNano()))
+	}
+	if packet.NodeID != nil {
+		headers = append(headers, fmt.Sprintf("NODE-ID: %s", hex.EncodeToString(packet.NodeID)))
+	}
+	return headers
 }
 
 func (packet *DiscoveryPacket) Bytes() (out []byte, err error) {
@@ -51,23 +96,29 @@ func (packet *DiscoveryPacket) Bytes() (out []byte, err error) {
 }
 
 func NewRequestDiscoveryPacket(address net.IP, port uint16) DiscoveryPacket {
-	return DiscoveryPacket{address, port, requestDiscoveryType}
+	return DiscoveryPacket{Address: address, Port: port, Type: requestDiscoveryType, Version: ProtocolVersion, MinVersion: MinProtocolVersion}
 }
 
 func NewResponseDiscoveryPacket(address net.IP, port uint16) DiscoveryPacket {
-	return DiscoveryPacket{address, port, responseDiscoveryType}
+	return DiscoveryPacket{Address: address, Port: port, Type: responseDiscoveryType, Version: ProtocolVersion, MinVersion: MinProtocolVersion}
+}
+
+func NewLeavingDiscoveryPacket(address net.IP, port uint16) DiscoveryPacket {
+	return DiscoveryPacket{Address: address, Port: port, Type: leavingDiscoveryType, Version: ProtocolVersion, MinVersion: MinProtocolVersion}
 }
 
 type RequestActionPacket struct {
 	RequestUUID uuid.UUID
 	ActionId    uint8
 	Parameters  map[string]interface{}
+	Version     uint8
 }
 
 type ResponseActionPacket struct {
 	RequestUUID uuid.UUID
 	Approved    bool
 	Content     map[string]interface{}
+	Version     uint8
 }
 
 func (packet *RequestActionPacket) String() (out string, err error) {
@@ -78,12 +129,11 @@ func (packet *RequestActionPacket) String() (out string, err error) {
 		return
 	}
 	headers := []string{requestActionIdentifier, requestUUIDHeader, actionHeader}
-	out = strings.Join(headers, headerSeparator) + headerSeparator
-	if packet.Parameters != nil {
-		out += headerSeparator + string(parametersJSON) + headerSeparator
+	headers = appendVersionHeaders(headers, packet.Version, packet.Version)
+	if packet.Parameters == nil {
+		parametersJSON = nil
 	}
-	out += endPacket
-	return out, err
+	return joinPacket(headers, parametersJSON), nil
 }
 
 func (packet *RequestActionPacket) Bytes() (out []byte, err error) {
@@ -106,12 +156,11 @@ func (packet *ResponseActionPacket) String() (out string, err error) {
 		return
 	}
 	headers := []string{responseActionIdentifier, requestUUIDHeader, approvedHeader}
-	out = strings.Join(headers, headerSeparator) + headerSeparator
-	if packet.Content != nil {
-		out += headerSeparator + string(contentJSON) + headerSeparator
+	headers = appendVersionHeaders(headers, packet.Version, packet.Version)
+	if packet.Content == nil {
+		contentJSON = nil
 	}
-	out += endPacket
-	return out, err
+	return joinPacket(headers, contentJSON), nil
 }
 
 func (packet *ResponseActionPacket) Bytes() (out []byte, err error) {
@@ -120,16 +169,55 @@ func (packet *ResponseActionPacket) Bytes() (out []byte, err error) {
 	return
 }
 
+// A PONG echoes the SEQUENCE and TIMESTAMP of its PING, so the round trip is measured on one clock
+type HeartbeatPacket struct {
+	Type      string
+	Sequence  uint64
+	Timestamp time.Time
+	Version   uint8
+}
+
+func (packet *HeartbeatPacket) String() (string, error) {
+	typeHeader := fmt.Sprintf("TYPE: %s", packet.Type)
+	sequenceHeader := fmt.Sprintf("SEQUENCE: %d", packet.Sequence)
+	timestampHeader := fmt.Sprintf("TIMESTAMP: %d", packet.Timestamp.UnixNano())
+	headers := []string{heartbeatIdentifier, typeHeader, sequenceHeader, timestampHeader}
+	headers = appendVersionHeaders(headers, packet.Version, packet.Version)
+	return joinPacket(headers, nil), nil
+}
+
+func (packet *HeartbeatPacket) Bytes() (out []byte, err error) {
+	packetString, err := packet.String()
+	out = []byte(packetString)
+	return
+}
+
+func NewPingPacket(sequence uint64) HeartbeatPacket {
+	return HeartbeatPacket{Type: pingHeartbeatType, Sequence: sequence, Timestamp: time.Unix(0, time.Now().UnixNano()), Version: ProtocolVersion}
+}
+
+func NewPongPacket(ping *HeartbeatPacket) HeartbeatPacket {
+	return HeartbeatPacket{Type: pongHeartbeatType, Sequence: ping.Sequence, Timestamp: ping.Timestamp, Version: ping.Version}
+}
+
 func NewRequestActionPacket(actionId uint8, parameters map[string]interface{}) RequestActionPacket {
-	return RequestActionPacket{uuid.New(), actionId, parameters}
+	return RequestActionPacket{uuid.New(), actionId, parameters, ProtocolVersion}
 }
 
 func NewResponseActionPacket(requestUUID uuid.UUID, approved bool, content map[string]interface{}) ResponseActionPacket {
-	return ResponseActionPacket{requestUUID, approved, content}
+	return ResponseActionPacket{requestUUID, approved, content, ProtocolVersion}
 }
 
 func ParsePacket(buffer *bytes.Buffer) (packet Packet, err error) {
-	identifier, err := readUntil(buffer, []byte(headerSeparator))
+	return ParsePacketWithLimits(buffer, DefaultPacketLimits)
+}
+
+func ParsePacketWithLimits(buffer *bytes.Buffer, limits PacketLimits) (packet Packet, err error) {
+	limits = limits.orDefault()
+	identifier, err := readLimitedLine(buffer, limits.MaxHeaderLength, ErrHeaderTooLong)
+	if err == io.EOF {
+		return packet, ErrTruncatedPacket
+	}
 	if err != nil {
 		return
 	}
@@ -138,58 +226,50 @@ func ParsePacket(buffer *bytes.Buffer) (packet Packet, err error) {
 	case requestActionIdentifier:
 		var packetRequestUUID uuid.UUID
 		var packetActionId uint64
-		var parametersBytes []byte
+		var packetVersion uint8
 		var parametersJSON map[string]interface{}
-		headers, err = readHeaders(buffer)
+		headers, err = readHeaders(buffer, limits)
 		if err != nil {
 			return
 		}
-		packetRequestUUIDString, ok := headers["REQUEST-UUID"]
-		if !ok {
-			return packet, errors.New("malformed packet: \"REQUEST-UUID\" header not found")
-		}
-		packetRequestUUID, err = uuid.Parse(packetRequestUUIDString)
+		packetRequestUUID, err = parseUUIDHeader(headers, "REQUEST-UUID")
 		if err != nil {
 			return
 		}
 		packetActionIdString, ok := headers["ACTION-ID"]
 		if !ok {
-			return packet, errors.New("malformed packet: \"ACTION-ID\" header not found")
+			return packet, &MissingHeaderError{"ACTION-ID"}
 		}
 		packetActionId, err = strconv.ParseUint(packetActionIdString, 10, 8)
+		if err != nil {
+			return packet, &InvalidHeaderValueError{"ACTION-ID", packetActionIdString, err}
+		}
+		packetVersion, err = parseVersionHeader(headers, "VERSION", 0)
 		if err != nil {
 			return
 		}
-		parametersBytes, err = readUntil(buffer, []byte(headerSeparator))
-		if err == nil {
-			err = json.Unmarshal(parametersBytes, &parametersJSON)
-			if err != nil {
-				return
-			}
+		parametersJSON, err = readBody(buffer, headers, limits)
+		if err != nil {
+			return
 		}
-		err = nil
-		packetObj := RequestActionPacket{packetRequestUUID, uint8(packetActionId), parametersJSON}
+		packetObj := RequestActionPacket{packetRequestUUID, uint8(packetActionId), parametersJSON, packetVersion}
 		packet = &packetObj
 	case responseActionIdentifier:
 		var packetRequestUUID uuid.UUID
 		var packetApproved bool
-		var contentBytes []byte
+		var packetVersion uint8
 		var contentJSON map[string]interface{}
-		headers, err = readHeaders(buffer)
+		headers, err = readHeaders(buffer, limits)
 		if err != nil {
 			return
 		}
-		packetRequestUUIDString, ok := headers["REQUEST-UUID"]
-		if !ok {
-			return packet, errors.New("malformed packet: \"REQUEST-UUID\" header not found")
-		}
-		packetRequestUUID, err = uuid.Parse(packetRequestUUIDString)
+		packetRequestUUID, err = parseUUIDHeader(headers, "REQUEST-UUID")
 		if err != nil {
 			return
 		}
 		packetApprovedString, ok := headers["APPROVED"]
 		if !ok {
-			return packet, errors.New("malformed packet: \"APPROVED\" header not found")
+			return packet, &MissingHeaderError{"APPROVED"}
 		}
 		switch packetApprovedString {
 		case "True":
@@ -197,100 +277,317 @@ func ParsePacket(buffer *bytes.Buffer) (packet Packet, err error) {
 		case "False":
 			packetApproved = false
 		default:
-			return packet, errors.New(fmt.Sprintf("malformed packet: APPROVED must be True or False"))
+			return packet, &InvalidHeaderValueError{"APPROVED", packetApprovedString, errors.New("must be True or False")}
 		}
-		contentBytes, err = readUntil(buffer, []byte(headerSeparator))
-		if err == nil {
-			err = json.Unmarshal(contentBytes, &contentJSON)
-			if err != nil {
-				return
-			}
+		packetVersion, err = parseVersionHeader(headers, "VERSION", 0)
+		if err != nil {
+			return
 		}
-		err = nil
-		packetObj := ResponseActionPacket{packetRequestUUID, packetApproved, contentJSON}
+		contentJSON, err = readBody(buffer, headers, limits)
+		if err != nil {
+			return
+		}
+		packetObj := ResponseActionPacket{packetRequestUUID, packetApproved, contentJSON, packetVersion}
 		packet = &packetObj
 	case discoveryIdentifier:
-		headers, err = readHeaders(buffer)
+		headers, err = readHeaders(buffer, limits)
 		if err != nil {
 			return
 		}
 		packetType, ok := headers["TYPE"]
 		if !ok {
-			return packet, errors.New("malformed packet: \"TYPE\" header not found")
+			return packet, &MissingHeaderError{"TYPE"}
 		}
 		packetHost, ok := headers["HOST"]
 		if !ok {
-			return packet, errors.New("malformed packet: \"HOST\" header not found")
+			return packet, &MissingHeaderError{"HOST"}
 		}
 		var host, portString string
 		host, portString, err = net.SplitHostPort(packetHost)
 		if err != nil {
-			return packet, errors.New("malformed packet: invalid ip/port pair")
+			return packet, &InvalidHeaderValueError{"HOST", packetHost, err}
 		}
 		ip := net.ParseIP(host)
 		if ip == nil {
-			return packet, errors.New("malformed packet: hostname is not supported")
+			return packet, &InvalidHeaderValueError{"HOST", packetHost, errors.New("hostname is not supported")}
 		}
 		var port uint64
 		port, err = strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			return packet, &InvalidHeaderValueError{"HOST", packetHost, err}
+		}
+		var packetVersion, packetMinVersion uint8
+		packetVersion, err = parseVersionHeader(headers, "VERSION", 0)
+		if err != nil {
+			return
+		}
+		packetMinVersion, err = parseVersionHeader(headers, "MIN-VERSION", packetVersion)
 		if err != nil {
 			return
 		}
+		if packetMinVersion > packetVersion {
+			return packet, &InvalidHeaderValueError{"MIN-VERSION", headers["MIN-VERSION"], errors.New("must not be greater than VERSION")}
+		}
+		var metadata DiscoveryMetadata
+		var query DiscoveryQuery
+		if packetType == requestDiscoveryType {
+			query, err = parseQueryHeaders(headers)
+		} else {
+			metadata, err = parseMetadataHeaders(headers)
+		}
+		if err != nil {
+			return
+		}
+		var nodeID, signature []byte
+		nodeID, err = parseHexHeader(headers, "NODE-ID", ed25519.PublicKeySize)
+		if err != nil {
+			return
+		}
+		if nodeID != nil {
+			signature, err = parseHexHeader(headers, "SIGNATURE", ed25519.SignatureSize)
+			if err != nil {
+				return
+			}
+		}
+		var timestamp time.Time
+		if timestampString, ok := headers["TIMESTAMP"]; ok {
+			var nanoseconds int64
+			nanoseconds, err = strconv.ParseInt(timestampString, 10, 64)
+			if err != nil {
+				return packet, &InvalidHeaderValueError{"TIMESTAMP", timestampString, err}
+			}
+			timestamp = time.Unix(0, nanoseconds)
+		}
 		switch packetType {
-		case requestDiscoveryType:
-			packetObj := NewRequestDiscoveryPacket(ip, uint16(port))
-			packet = &packetObj
-		case responseDiscoveryType:
-			packetObj := NewResponseDiscoveryPacket(ip, uint16(port))
+		case requestDiscoveryType, responseDiscoveryType, leavingDiscoveryType:
+			packetObj := DiscoveryPacket{ip, uint16(port), packetType, packetVersion, packetMinVersion, nodeID, signature, metadata, query, timestamp}
 			packet = &packetObj
 		default:
-			return packet, errors.New(fmt.Sprintf("malformed packet: type \"%s\" not supported", packetType))
+			return packet, &InvalidHeaderValueError{"TYPE", packetType, errors.New("type not supported")}
+		}
+	case heartbeatIdentifier:
+		headers, err = readHeaders(buffer, limits)
+		if err != nil {
+			return
 		}
+		packetType, ok := headers["TYPE"]
+		if !ok {
+			return packet, &MissingHeaderError{"TYPE"}
+		}
+		if packetType != pingHeartbeatType && packetType != pongHeartbeatType {
+			return packet, &InvalidHeaderValueError{"TYPE", packetType, errors.New("type not supported")}
+		}
+		sequenceString, ok := headers["SEQUENCE"]
+		if !ok {
+			return packet, &MissingHeaderError{"SEQUENCE"}
+		}
+		var sequence uint64
+		sequence, err = strconv.ParseUint(sequenceString, 10, 64)
+		if err != nil {
+			return packet, &InvalidHeaderValueError{"SEQUENCE", sequenceString, err}
+		}
+		timestampString, ok := headers["TIMESTAMP"]
+		if !ok {
+			return packet, &MissingHeaderError{"TIMESTAMP"}
+		}
+		var timestamp int64
+		timestamp, err = strconv.ParseInt(timestampString, 10, 64)
+		if err != nil {
+			return packet, &InvalidHeaderValueError{"TIMESTAMP", timestampString, err}
+		}
+		var packetVersion uint8
+		packetVersion, err = parseVersionHeader(headers, "VERSION", 0)
+		if err != nil {
+			return
+		}
+		packetObj := HeartbeatPacket{packetType, sequence, time.Unix(0, timestamp), packetVersion}
+		packet = &packetObj
 	default:
-		err = errors.New("malformed packet: identifier not knwon")
+		err = ErrUnknownIdentifier
 	}
 	return packet, err
 }
 
 func readUntil(buffer *bytes.Buffer, delim []byte) ([]byte, error) {
-	var err error
-	var readByte byte
-	out := make([]byte, 0, buffer.Cap())
-	read := make([]byte, len(delim))
-	for !bytes.Equal(read, delim) && err != io.EOF {
-		readByte, err = buffer.ReadByte()
-		if err != io.EOF {
-			out = append(out, readByte)
+	index := bytes.Index(buffer.Bytes(), delim)
+	if index < 0 || len(delim) == 0 {
+		out := make([]byte, buffer.Len())
+		copy(out, buffer.Next(buffer.Len()))
+		return out, io.EOF
+	}
+	out := make([]byte, index+len(delim))
+	copy(out, buffer.Next(len(out)))
+	return out, nil
+}
+
+// Fails without consuming the buffer when no line break is found within maxLength bytes
+func readLimitedLine(buffer *bytes.Buffer, maxLength int, limitErr error) ([]byte, error) {
+	window := buffer.Bytes()
+	if len(window) > maxLength+len(headerSeparator) {
+		window = window[:maxLength+len(headerSeparator)]
+		if !bytes.Contains(window, []byte(headerSeparator)) {
+			return nil, limitErr
 		}
-		read[0] = read[1]
-		read[1] = readByte
 	}
-	readOut := make([]byte, len(out))
-	copy(readOut, out)
-	return readOut, err
+	return readUntil(buffer, []byte(headerSeparator))
 }
 
-func readHeaders(buffer *bytes.Buffer) (headers map[string]string, err error) {
+func readHeaders(buffer *bytes.Buffer, limits PacketLimits) (headers map[string]string, err error) {
+	limits = limits.orDefault()
 	headers = make(map[string]string)
-	headerRaw, err := readUntil(buffer, []byte(headerSeparator))
+	headerRaw, err := readLimitedLine(buffer, limits.MaxHeaderLength, ErrHeaderTooLong)
 	var headerPair []string
 	var header string
-	for err == nil && string(headerRaw) != "\r\n" {
+	for lines := 0; err == nil && string(headerRaw) != "\r\n"; lines++ {
+		if lines == limits.MaxHeaderLines {
+			return headers, ErrTooManyHeaders
+		}
 		header = strings.TrimRight(string(headerRaw), "\r\n")
 		headerPair, err = parseHeader(header)
 		if err != nil {
 			return
 		}
-		headers[headerPair[0]] = headerPair[1]
-		headerRaw, err = readUntil(buffer, []byte(headerSeparator))
+		//Signers append their SIGNATURE after the headers they cover, so the first occurrence is kept
+		if _, ok := headers[headerPair[0]]; !ok {
+			headers[headerPair[0]] = headerPair[1]
+		}
+		headerRaw, err = readLimitedLine(buffer, limits.MaxHeaderLength, ErrHeaderTooLong)
+	}
+	if err == io.EOF {
+		err = ErrTruncatedPacket
 	}
 	return headers, err
 }
 
+func readBody(buffer *bytes.Buffer, headers map[string]string, limits PacketLimits) (body map[string]interface{}, err error) {
+	contentLength, ok, err := parseContentLength(headers)
+	if err != nil {
+		return
+	}
+	var bodyBytes []byte
+	if ok {
+		if contentLength > limits.MaxBodySize {
+			return nil, ErrBodyTooLarge
+		}
+		bodyBytes = buffer.Next(contentLength)
+		if len(bodyBytes) < contentLength {
+			return nil, ErrTruncatedPacket
+		}
+		if buffer.Len() < len(headerSeparator) {
+			return nil, ErrTruncatedPacket
+		}
+		if !bytes.HasPrefix(buffer.Bytes(), []byte(headerSeparator)) {
+			return nil, &InvalidBodyError{errors.New("body is longer than CONTENT-LENGTH")}
+		}
+		buffer.Next(len(headerSeparator))
+	} else {
+		//Legacy packets have no CONTENT-LENGTH and end the body at the first line break,
+		//anything but a JSON object after their headers is the next packet
+		_, versioned := headers["VERSION"]
+		if versioned || !bytes.HasPrefix(buffer.Bytes(), []byte("{")) {
+			return nil, nil
+		}
+		bodyBytes, err = readLimitedLine(buffer, limits.MaxBodySize, ErrBodyTooLarge)
+		if err == ErrBodyTooLarge {
+			return
+		}
+	}
+	err = json.Unmarshal(bodyBytes, &body)
+	if err != nil {
+		return nil, &InvalidBodyError{err}
+	}
+	//The empty line closing the packet, so the buffer is left at the next one
+	skipLine(buffer)
+	return
+}
+
+// Drops the line break the buffer starts with, a datagram may end without it
+func skipLine(buffer *bytes.Buffer) {
+	if bytes.HasPrefix(buffer.Bytes(), []byte(headerSeparator)) {
+		buffer.Next(len(headerSeparator))
+	}
+}
+
+func parseContentLength(headers map[string]string) (contentLength int, ok bool, err error) {
+	contentLengthString, ok := headers["CONTENT-LENGTH"]
+	if !ok {
+		return
+	}
+	length, err := strconv.ParseUint(contentLengthString, 10, 31)
+	if err != nil {
+		return 0, ok, &InvalidHeaderValueError{"CONTENT-LENGTH", contentLengthString, err}
+	}
+	return int(length), ok, nil
+}
+
+func parseHexHeader(headers map[string]string, header string, size int) (value []byte, err error) {
+	valueString, ok := headers[header]
+	if !ok {
+		return
+	}
+	value, err = hex.DecodeString(valueString)
+	if err == nil && len(value) != size {
+		err = fmt.Errorf("must be %d bytes long", size)
+	}
+	if err != nil {
+		return nil, &InvalidHeaderValueError{header, valueString, err}
+	}
+	return
+}
+
+func parseUUIDHeader(headers map[string]string, header string) (value uuid.UUID, err error) {
+	valueString, ok := headers[header]
+	if !ok {
+		return value, &MissingHeaderError{header}
+	}
+	value, err = uuid.Parse(valueString)
+	if err != nil {
+		return value, &InvalidHeaderValueError{header, valueString, err}
+	}
+	return
+}
+
+func joinPacket(headers []string, body []byte) string {
+	if body != nil {
+		headers = append(headers, fmt.Sprintf("CONTENT-LENGTH: %d", len(body)))
+	}
+	out := strings.Join(headers, headerSeparator) + headerSeparator
+	if body != nil {
+		out += headerSeparator + string(body) + headerSeparator
+	}
+	return out + endPacket
+}
+
+func appendVersionHeaders(headers []string, version uint8, minVersion uint8) []string {
+	if version == 0 {
+		return headers
+	}
+	headers = append(headers, fmt.Sprintf("VERSION: %d", version))
+	if minVersion < version {
+		headers = append(headers, fmt.Sprintf("MIN-VERSION: %d", minVersion))
+	}
+	return headers
+}
+
+func parseVersionHeader(headers map[string]string, header string, defaultVersion uint8) (uint8, error) {
+	versionString, ok := headers[header]
+	if !ok {
+		return defaultVersion, nil
+	}
+	version, err := strconv.ParseUint(versionString, 10, 8)
+	if err != nil {
+		return 0, &InvalidHeaderValueError{header, versionString, err}
+	}
+	if version == 0 {
+		return 0, &InvalidHeaderValueError{header, versionString, errors.New("version must be greater than 0")}
+	}
+	return uint8(version), nil
+}
+
 func parseHeader(raw string) ([]string, error) {
 	headerValue := strings.SplitN(raw, ": ", 2)
 	if len(headerValue) == 1 {
-		return []string{}, errors.New("invalid header line")
+		return []string{}, &InvalidHeaderLineError{raw}
 	}
 	return headerValue, nil
 }
@@ -3,12 +3,14 @@ package network
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/google/uuid"
@@ -25,6 +27,7 @@ func TestRequestDiscoveryPacket(t *testing.T) {
 	expectedString := "DYLLABLE-DISCOVERY\r\n" +
 		"TYPE: DISCOVERY\r\n" +
 		"HOST: 127.0.0.1:8400\r\n" +
+		"VERSION: 1\r\n" +
 		"\r\n"
 	if packetString != expectedString {
 		t.Fatalf("RequestDiscoveryPacket String() does not "+
@@ -53,6 +56,7 @@ func TestResponseDiscoveryPacket(t *testing.T) {
 	expectedString := "DYLLABLE-DISCOVERY\r\n" +
 		"TYPE: RUNNING-APP\r\n" +
 		"HOST: 127.0.0.1:8400\r\n" +
+		"VERSION: 1\r\n" +
 		"\r\n"
 	if packetString != expectedString {
 		t.Fatalf("ResponseDiscoveryPacket String() does not "+
@@ -124,6 +128,48 @@ func TestParseResponseDiscoveryPacket(t *testing.T) {
 	}
 }
 
+func TestIPv6DiscoveryPacket(t *testing.T) {
+	var port uint16 = 8400
+	addresses := map[string]string{
+		"::1":                "[::1]:8400",
+		"fd00::2":            "[fd00::2]:8400",
+		"2001:db8::1:0:0:1":  "[2001:db8::1:0:0:1]:8400",
+		"::ffff:192.0.2.1":   "192.0.2.1:8400",
+		"fe80::fc:ff:fe00:1": "[fe80::fc:ff:fe00:1]:8400",
+	}
+	for address, host := range addresses {
+		packet := NewResponseDiscoveryPacket(net.ParseIP(address), port)
+		packetString, err := packet.String()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		expectedString := "DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: RUNNING-APP\r\n" +
+			fmt.Sprintf("HOST: %s\r\n", host) +
+			"VERSION: 1\r\n" +
+			"\r\n"
+		if packetString != expectedString {
+			t.Fatalf("ResponseDiscoveryPacket String() does not "+
+				"match to the expected.\ncurrent:\n%#v.\nexpected:\n%#v\n", packetString, expectedString)
+		}
+
+		parsedPacket, err := ParsePacket(bytes.NewBuffer([]byte(packetString)))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		discoveryPacket, ok := parsedPacket.(*DiscoveryPacket)
+		if !ok {
+			t.Fatalf("expected DiscoveryPacket object instead of %T", parsedPacket)
+		}
+		if !discoveryPacket.Address.Equal(net.ParseIP(address)) {
+			t.Fatalf("expected parsed packet IP equals to \"%s\" instead of \"%v\"", address, discoveryPacket.Address)
+		}
+		if discoveryPacket.Port != port {
+			t.Fatalf("expected parsed packet port equals to \"8400\" instead of \"%v\"", discoveryPacket.Port)
+		}
+	}
+}
+
 func TestParseInvalidDiscoveryPacket(t *testing.T) {
 	invalidPackets := []string{
 		"TYPE: DISCOVERY\r\n" +
@@ -155,6 +201,14 @@ func TestParseInvalidDiscoveryPacket(t *testing.T) {
 			"TYPE: INVALID\n" +
 			"HOST: 127.0.0.1:8400\r\n" +
 			"\n",
+		"DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: DISCOVERY\r\n" +
+			"HOST: ::1:8400\r\n" +
+			"\r\n",
+		"DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: DISCOVERY\r\n" +
+			"HOST: [127.0.0.1:8400\r\n" +
+			"\r\n",
 	}
 
 	var packetBuffer *bytes.Buffer
@@ -241,6 +295,8 @@ func TestRequestActionPacket(t *testing.T) {
 	expectedString := "DYLLABLE-ACTION-REQUEST\r\n" +
 		fmt.Sprintf("REQUEST-UUID: %s\r\n", requestUUID) +
 		fmt.Sprintf("ACTION-ID: %d\r\n", actionId) +
+		"VERSION: 1\r\n" +
+		"CONTENT-LENGTH: 49\r\n" +
 		"\r\n" +
 		"{\"key\":\"value\",\"key2\":10,\"key3\":true,\"key4\":15.7}\r\n" +
 		"\r\n"
@@ -277,6 +333,7 @@ func TestRequestActionPacket(t *testing.T) {
 	expectedString = "DYLLABLE-ACTION-REQUEST\r\n" +
 		fmt.Sprintf("REQUEST-UUID: %s\r\n", requestUUID) +
 		fmt.Sprintf("ACTION-ID: %d\r\n", actionId) +
+		"VERSION: 1\r\n" +
 		"\r\n"
 
 	if packetString != expectedString {
@@ -320,6 +377,8 @@ func TestResponseActionPacket(t *testing.T) {
 	expectedString := "DYLLABLE-ACTION-RESPONSE\r\n" +
 		fmt.Sprintf("REQUEST-UUID: %s\r\n", requestUUID) +
 		"APPROVED: False\r\n" +
+		"VERSION: 1\r\n" +
+		"CONTENT-LENGTH: 49\r\n" +
 		"\r\n" +
 		"{\"key\":\"value\",\"key2\":10,\"key3\":true,\"key4\":15.7}\r\n" +
 		"\r\n"
@@ -356,6 +415,7 @@ func TestResponseActionPacket(t *testing.T) {
 	expectedString = "DYLLABLE-ACTION-RESPONSE\r\n" +
 		fmt.Sprintf("REQUEST-UUID: %s\r\n", requestUUID) +
 		"APPROVED: True\r\n" +
+		"VERSION: 1\r\n" +
 		"\r\n"
 
 	if packetString != expectedString {
@@ -416,6 +476,46 @@ func TestParseRequestActionPacket(t *testing.T) {
 	}
 }
 
+func TestParseActionPacketContentLength(t *testing.T) {
+	var requestUUID = uuid.New()
+	body := "{\r\n\"key\": \"value\"\r\n}"
+	packetString := "DYLLABLE-ACTION-RESPONSE\r\n" +
+		fmt.Sprintf("REQUEST-UUID: %s\r\n", requestUUID) +
+		"APPROVED: True\r\n" +
+		fmt.Sprintf("CONTENT-LENGTH: %d\r\n", len(body)) +
+		"\r\n" +
+		body + "\r\n" +
+		"\r\n"
+
+	packet, err := ParsePacket(bytes.NewBuffer([]byte(packetString)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	actionPacket, ok := packet.(*ResponseActionPacket)
+	if !ok {
+		t.Fatalf("expected ResponseActionPacket object instead of %T", packet)
+	}
+	if actionPacket.Content["key"] != "value" {
+		t.Fatalf("expected parsed packet content with line breaks instead of \"%v\"", actionPacket.Content)
+	}
+
+	_, err = ParsePacket(bytes.NewBuffer([]byte(packetString[:len(packetString)-10])))
+	if err != ErrTruncatedPacket {
+		t.Fatalf("expected ErrTruncatedPacket for a truncated body instead of %v", err)
+	}
+
+	longer := strings.Replace(packetString, body, body+"{}", 1)
+	_, err = ParsePacket(bytes.NewBuffer([]byte(longer)))
+	var bodyErr *InvalidBodyError
+	if !errors.As(err, &bodyErr) {
+		t.Fatalf("expected InvalidBodyError for a body longer than CONTENT-LENGTH instead of %v", err)
+	}
+	_, err = NewPacketDecoder(strings.NewReader(longer)).Decode()
+	if !errors.As(err, &bodyErr) {
+		t.Fatalf("expected the decoder to fail with InvalidBodyError as well instead of %v", err)
+	}
+}
+
 func TestParseRequestActionPacketWithoutParameters(t *testing.T) {
 	var requestUUID = uuid.New()
 	var actionId uint8 = 10
@@ -617,3 +717,223 @@ func TestParseInvalidResponseActionPacket(t *testing.T) {
 		}
 	}
 }
+
+func TestHeartbeatPacket(t *testing.T) {
+	ping := NewPingPacket(42)
+	pong := NewPongPacket(&ping)
+	if pong.Type != "PONG" || pong.Sequence != 42 || !pong.Timestamp.Equal(ping.Timestamp) {
+		t.Fatalf("expected PONG echoing sequence 42 and timestamp %v instead of %#v", ping.Timestamp, pong)
+	}
+	expected := "DYLLABLE-HEARTBEAT\r\n" +
+		"TYPE: PONG\r\n" +
+		"SEQUENCE: 42\r\n" +
+		fmt.Sprintf("TIMESTAMP: %d\r\n", ping.Timestamp.UnixNano()) +
+		"VERSION: 1\r\n" +
+		"\r\n"
+	packetString, err := pong.String()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if packetString != expected {
+		t.Fatalf("expected packet string %#v instead of %#v", expected, packetString)
+	}
+}
+
+func TestParseInvalidHeartbeatPacket(t *testing.T) {
+	var invalidHeartbeats = map[string]string{
+		"TYPE":      "DYLLABLE-HEARTBEAT\r\nTYPE: PANG\r\nSEQUENCE: 1\r\nTIMESTAMP: 1\r\n\r\n",
+		"SEQUENCE":  "DYLLABLE-HEARTBEAT\r\nTYPE: PING\r\nSEQUENCE: -1\r\nTIMESTAMP: 1\r\n\r\n",
+		"TIMESTAMP": "DYLLABLE-HEARTBEAT\r\nTYPE: PING\r\nSEQUENCE: 1\r\nTIMESTAMP: now\r\n\r\n",
+	}
+	for header, packetString := range invalidHeartbeats {
+		_, err := ParsePacket(bytes.NewBuffer([]byte(packetString)))
+		var invalidErr *InvalidHeaderValueError
+		if !errors.As(err, &invalidErr) || invalidErr.Header != header {
+			t.Fatalf("expected invalid %s header instead of %v", header, err)
+		}
+	}
+	_, err := ParsePacket(bytes.NewBuffer([]byte("DYLLABLE-HEARTBEAT\r\nTYPE: PING\r\nSEQUENCE: 1\r\n\r\n")))
+	var missingErr *MissingHeaderError
+	if !errors.As(err, &missingErr) || missingErr.Header != "TIMESTAMP" {
+		t.Fatalf("expected missing TIMESTAMP header instead of %v", err)
+	}
+}
+
+var packetSeedCorpus = []string{
+	"DYLLABLE-DISCOVERY\r\n" +
+		"TYPE: DISCOVERY\r\n" +
+		"HOST: 127.0.0.1:8400\r\n" +
+		"VERSION: 1\r\n" +
+		"\r\n",
+	"DYLLABLE-DISCOVERY\r\n" +
+		"TYPE: RUNNING-APP\r\n" +
+		"HOST: [fe80::1]:8400\r\n" +
+		"VERSION: 3\r\n" +
+		"MIN-VERSION: 1\r\n" +
+		"\r\n",
+	"DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: 95bcd112-c138-4ca6-9df9-f4c508b9c0c1\r\n" +
+		"ACTION-ID: 1\r\n" +
+		"VERSION: 1\r\n" +
+		"CONTENT-LENGTH: 49\r\n" +
+		"\r\n" +
+		"{\"key\":\"value\",\"key2\":10,\"key3\":true,\"key4\":15.7}\r\n" +
+		"\r\n",
+	"DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: 95bcd112-c138-4ca6-9df9-f4c508b9c0c1\r\n" +
+		"ACTION-ID: 1\r\n" +
+		"\r\n" +
+		"{\"key\":\"value\"}\r\n" +
+		"\r\n",
+	"DYLLABLE-ACTION-RESPONSE\r\n" +
+		"REQUEST-UUID: 95bcd112-c138-4ca6-9df9-f4c508b9c0c1\r\n" +
+		"APPROVED: True\r\n" +
+		"VERSION: 1\r\n" +
+		"CONTENT-LENGTH: 20\r\n" +
+		"\r\n" +
+		"{\r\n\"key\": \"value\"\r\n}\r\n" +
+		"\r\n",
+	"DYLLABLE-ACTION-RESPONSE\r\n" +
+		"REQUEST-UUID: 95bcd112-c138-4ca6-9df9-f4c508b9c0c1\r\n" +
+		"APPROVED: False\r\n" +
+		"\r\n",
+	"DYLLABLE-HEARTBEAT\r\n" +
+		"TYPE: PING\r\n" +
+		"SEQUENCE: 1\r\n" +
+		"TIMESTAMP: 1700000000000000000\r\n" +
+		"VERSION: 1\r\n" +
+		"\r\n",
+	"DYLLABLE-DISCOVERY\r\nTYPE DISCOVERY\r\n\r\n",
+	"DYLLABLE-DISCOVERY",
+}
+
+func FuzzParsePacket(f *testing.F) {
+	for _, seed := range packetSeedCorpus {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := ParsePacket(bytes.NewBuffer(data))
+		if err != nil {
+			if packet != nil {
+				t.Fatalf("expected no packet along with error %v", err)
+			}
+			if !errors.Is(err, ErrMalformedPacket) {
+				t.Fatalf("expected a ErrMalformedPacket instead of %v", err)
+			}
+			return
+		}
+		//Encoding a parsed packet must be stable
+		encoded, err := packet.String()
+		if err != nil {
+			return
+		}
+		reparsed, err := ParsePacket(bytes.NewBuffer([]byte(encoded)))
+		if err != nil {
+			t.Fatalf("encoded packet could not be parsed back: %v\n%#v", err, encoded)
+		}
+		reencoded, _ := reparsed.String()
+		if reencoded != encoded {
+			t.Fatalf("expected the packet to be encoded as\n%#v\ninstead of\n%#v", encoded, reencoded)
+		}
+	})
+}
+
+func FuzzReadHeaders(f *testing.F) {
+	for _, seed := range packetSeedCorpus {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		buffer := bytes.NewBuffer(data)
+		headers, err := readHeaders(buffer, DefaultPacketLimits)
+		if err != nil {
+			if !errors.Is(err, ErrMalformedPacket) {
+				t.Fatalf("expected a ErrMalformedPacket instead of %v", err)
+			}
+			return
+		}
+		if len(headers) > DefaultPacketLimits.MaxHeaderLines {
+			t.Fatalf("expected at most %d headers instead of %d", DefaultPacketLimits.MaxHeaderLines, len(headers))
+		}
+		for header, value := range headers {
+			if len(header)+len(": ")+len(value) > DefaultPacketLimits.MaxHeaderLength {
+				t.Fatalf("header %q is longer than %d bytes", header, DefaultPacketLimits.MaxHeaderLength)
+			}
+		}
+	})
+}
+
+func FuzzParseHeader(f *testing.F) {
+	f.Add("TYPE: DISCOVERY")
+	f.Add("HOST: [fe80::1]:8400")
+	f.Add("TYPE DISCOVERY")
+	f.Add("KEY: : VALUE")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, raw string) {
+		headerPair, err := parseHeader(raw)
+		if err != nil {
+			if !errors.Is(err, ErrMalformedPacket) {
+				t.Fatalf("expected a ErrMalformedPacket instead of %v", err)
+			}
+			return
+		}
+		if len(headerPair) != 2 || headerPair[0]+": "+headerPair[1] != raw {
+			t.Fatalf("expected %q to be split into header and value instead of %q", raw, headerPair)
+		}
+	})
+}
+
+func TestParsePacketLimits(t *testing.T) {
+	limits := PacketLimits{MaxHeaderLines: 4, MaxHeaderLength: 64, MaxBodySize: 16}
+	requestUUID := "95bcd112-c138-4ca6-9df9-f4c508b9c0c1"
+
+	tooManyHeaders := "DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: " + requestUUID + "\r\n" +
+		"ACTION-ID: 1\r\n" +
+		"A: 1\r\n" +
+		"B: 2\r\n" +
+		"C: 3\r\n" +
+		"\r\n"
+	headerTooLong := "DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: " + requestUUID + "\r\n" +
+		"ACTION-ID: 1\r\n" +
+		"PADDING: " + strings.Repeat("A", 64) + "\r\n" +
+		"\r\n"
+	bodyTooLarge := "DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: " + requestUUID + "\r\n" +
+		"ACTION-ID: 1\r\n" +
+		"CONTENT-LENGTH: 17\r\n" +
+		"\r\n" +
+		"{\"key\":\"value12\"}\r\n" +
+		"\r\n"
+	legacyBodyTooLarge := "DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: " + requestUUID + "\r\n" +
+		"ACTION-ID: 1\r\n" +
+		"\r\n" +
+		"{\"key\":\"value12\"}\r\n" +
+		"\r\n"
+	identifierTooLong := strings.Repeat("DYLLABLE", 10) + "\r\n\r\n"
+
+	limitErrors := map[string]error{
+		tooManyHeaders:     ErrTooManyHeaders,
+		headerTooLong:      ErrHeaderTooLong,
+		bodyTooLarge:       ErrBodyTooLarge,
+		legacyBodyTooLarge: ErrBodyTooLarge,
+		identifierTooLong:  ErrHeaderTooLong,
+	}
+	for packetString, expected := range limitErrors {
+		_, err := ParsePacketWithLimits(bytes.NewBuffer([]byte(packetString)), limits)
+		if err != expected {
+			t.Fatalf("expected %v instead of %v for packet:\n%s", expected, err, packetString)
+		}
+		decoder := NewPacketDecoder(strings.NewReader(packetString))
+		decoder.SetCodec(TextCodec{Limits: limits})
+		_, err = decoder.Decode()
+		if err != expected {
+			t.Fatalf("expected decoder to fail with %v instead of %v for packet:\n%s", expected, err, packetString)
+		}
+		_, err = ParsePacket(bytes.NewBuffer([]byte(packetString)))
+		if err == expected {
+			t.Fatalf("packet should not exceed the default limits:\n%s", packetString)
+		}
+	}
+}
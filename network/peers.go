@@ -0,0 +1,209 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type PeerEventType uint8
+
+const minPeerSweep = time.Millisecond
+
+const (
+	PeerJoined PeerEventType = iota
+	PeerLeft
+	PeerUpdated
+	PeerSuspected
+	PeerRecovered
+	PeerDead
+	PeerIncompatible
+)
+
+type Peer struct {
+	Address   *net.TCPAddr
+	NodeID    ed25519.PublicKey
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Metadata  DiscoveryMetadata
+	//Protocol version agreed on through discovery, used for the requests sent to the peer
+	Version uint8
+	//Latest signed announcement, a LEAVING signed before it is a replay
+	announced time.Time
+}
+
+type PeerEvent struct {
+	Type PeerEventType
+	Peer Peer
+	//Why the peer can't be talked to, set on PeerIncompatible
+	Err error
+}
+
+type PeerRegistry struct {
+	ttl    time.Duration
+	events chan PeerEvent
+	mutex  sync.Mutex
+	peers  map[string]*Peer
+}
+
+func (eventType PeerEventType) String() string {
+	switch eventType {
+	case PeerJoined:
+		return "JOINED"
+	case PeerLeft:
+		return "LEFT"
+	case PeerUpdated:
+		return "UPDATED"
+	case PeerSuspected:
+		return "SUSPECTED"
+	case PeerRecovered:
+		return "RECOVERED"
+	case PeerDead:
+		return "DEAD"
+	case PeerIncompatible:
+		return "INCOMPATIBLE"
+	}
+	return "UNKNOWN"
+}
+
+// A ttl that is not positive falls back to the one of a node with DefaultDiscoveryConfig
+func NewPeerRegistry(ttl time.Duration, events chan PeerEvent) *PeerRegistry {
+	if ttl <= 0 {
+		ttl = peerTTLProbes * DefaultDiscoveryConfig.ProbeInterval
+	}
+	return &PeerRegistry{ttl: ttl, events: events, peers: make(map[string]*Peer)}
+}
+
+func (registry *PeerRegistry) Run(ctx context.Context, discoveredNodes chan *DiscoveredNode) (err error) {
+	defer close(registry.events)
+
+	//Peers are swept twice per TTL, but no more often than the shortest sweep
+	sweep := registry.ttl / 2
+	if sweep < minPeerSweep {
+		sweep = minPeerSweep
+	}
+	ticker := time.NewTicker(sweep)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case discoveredNode, ok := <-discoveredNodes:
+			if !ok {
+				return
+			}
+			for _, event := range registry.observe(discoveredNode, time.Now()) {
+				registry.emit(ctx, event)
+			}
+		case now := <-ticker.C:
+			for _, event := range registry.expire(now) {
+				registry.emit(ctx, event)
+			}
+		}
+	}
+}
+
+func (registry *PeerRegistry) Peers() []Peer {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	peers := make([]Peer, 0, len(registry.peers))
+	for _, peer := range registry.peers {
+		peers = append(peers, *peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Address.String() < peers[j].Address.String()
+	})
+	return peers
+}
+
+func (registry *PeerRegistry) hasNodeID(nodeID ed25519.PublicKey) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	_, ok := registry.peers[FormatNodeID(nodeID)]
+	return ok
+}
+
+func (registry *PeerRegistry) observe(discoveredNode *DiscoveredNode, now time.Time) (events []PeerEvent) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	//A verified NODE-ID identifies the peer even when its address changes
+	key := discoveredNode.Address.String()
+	if discoveredNode.NodeID != nil {
+		key = FormatNodeID(discoveredNode.NodeID)
+	}
+	//Only the verified node holding an address speaks for it, while an unsigned
+	//entry gives way to the verified node announcing the same address
+	holderKey, holder := registry.holding(discoveredNode.Address)
+	if holder != nil && holderKey != key && !discoveredNode.Leaving {
+		if holder.NodeID != nil {
+			return
+		}
+		delete(registry.peers, holderKey)
+		events = append(events, PeerEvent{PeerLeft, *holder, nil})
+	}
+	peer, ok := registry.peers[key]
+	switch {
+	case discoveredNode.Leaving:
+		if ok && (peer.announced.IsZero() || discoveredNode.Announced.After(peer.announced)) {
+			delete(registry.peers, key)
+			events = append(events, PeerEvent{PeerLeft, *peer, nil})
+		}
+	case !ok:
+		peer = &Peer{Address: discoveredNode.Address, NodeID: discoveredNode.NodeID, FirstSeen: now, LastSeen: now, Metadata: discoveredNode.Metadata, Version: discoveredNode.Version, announced: discoveredNode.Announced}
+		registry.peers[key] = peer
+		events = append(events, PeerEvent{PeerJoined, *peer, nil})
+	default:
+		peer.LastSeen = now
+		if discoveredNode.Announced.After(peer.announced) {
+			peer.announced = discoveredNode.Announced
+		}
+		//Being seen again is not news, only a new address or lobby state is
+		changed := peer.Address.String() != discoveredNode.Address.String()
+		peer.Address = discoveredNode.Address
+		//Requests carry a query instead of metadata, so they don't clear what the peer advertised
+		if !discoveredNode.Metadata.IsZero() && discoveredNode.Metadata != peer.Metadata {
+			peer.Metadata = discoveredNode.Metadata
+			changed = true
+		}
+		if discoveredNode.Version != 0 && discoveredNode.Version != peer.Version {
+			peer.Version = discoveredNode.Version
+			changed = true
+		}
+		if changed {
+			events = append(events, PeerEvent{PeerUpdated, *peer, nil})
+		}
+	}
+	return
+}
+
+func (registry *PeerRegistry) holding(address *net.TCPAddr) (string, *Peer) {
+	for key, peer := range registry.peers {
+		if peer.Address.String() == address.String() {
+			return key, peer
+		}
+	}
+	return "", nil
+}
+
+func (registry *PeerRegistry) expire(now time.Time) (events []PeerEvent) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for key, peer := range registry.peers {
+		if now.Sub(peer.LastSeen) >= registry.ttl {
+			delete(registry.peers, key)
+			events = append(events, PeerEvent{PeerLeft, *peer, nil})
+		}
+	}
+	return
+}
+
+func (registry *PeerRegistry) emit(ctx context.Context, event PeerEvent) {
+	select {
+	case registry.events <- event:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,298 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+)
+
+func expectPeerEvent(t *testing.T, events chan PeerEvent, eventType PeerEventType, address *net.TCPAddr) PeerEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		if event.Type != eventType {
+			t.Fatalf("expected %s event instead of %s", eventType, event.Type)
+		}
+		if event.Peer.Address.String() != address.String() {
+			t.Fatalf("expected event for peer %s instead of %s", address, event.Peer.Address)
+		}
+		return event
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expected %s event for peer %s", eventType, address)
+	}
+	return PeerEvent{}
+}
+
+func TestPeerRegistryDeduplicatesPeers(t *testing.T) {
+	discoveredNodes := make(chan *DiscoveredNode)
+	events := make(chan PeerEvent, 10)
+	registry := NewPeerRegistry(10*time.Second, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go registry.Run(ctx, discoveredNodes)
+
+	address, _ := net.ResolveTCPAddr("tcp4", "10.0.10.1:8401")
+	otherAddress, _ := net.ResolveTCPAddr("tcp4", "10.0.10.2:8401")
+
+	discoveredNodes <- &DiscoveredNode{Address: address}
+	joined := expectPeerEvent(t, events, PeerJoined, address)
+	discoveredNodes <- &DiscoveredNode{Address: address}
+	discoveredNodes <- &DiscoveredNode{Address: otherAddress}
+	expectPeerEvent(t, events, PeerJoined, otherAddress)
+
+	peers := registry.Peers()
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 peers in the registry instead of %d", len(peers))
+	}
+	if peers[0].Address.String() != address.String() || peers[1].Address.String() != otherAddress.String() {
+		t.Fatalf("unexpected peers in the registry: %v", peers)
+	}
+	if peers[0].FirstSeen != joined.Peer.FirstSeen {
+		t.Fatalf("FirstSeen should not change when a peer is seen again")
+	}
+	if peers[0].LastSeen.Before(joined.Peer.LastSeen) {
+		t.Fatalf("LastSeen should be refreshed when a peer is seen again")
+	}
+}
+
+func TestPeerRegistryReportsOnlyChanges(t *testing.T) {
+	discoveredNodes := make(chan *DiscoveredNode)
+	events := make(chan PeerEvent, 10)
+	registry := NewPeerRegistry(10*time.Second, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go registry.Run(ctx, discoveredNodes)
+
+	address, _ := net.ResolveTCPAddr("tcp4", "10.0.10.1:8401")
+	metadata := DiscoveryMetadata{Players: 1, MaxPlayers: 4}
+	discoveredNodes <- &DiscoveredNode{Address: address, Metadata: metadata}
+	expectPeerEvent(t, events, PeerJoined, address)
+	discoveredNodes <- &DiscoveredNode{Address: address, Metadata: metadata}
+	discoveredNodes <- &DiscoveredNode{Address: address}
+	select {
+	case event := <-events:
+		t.Fatalf("a peer seen again unchanged should not be reported, got %s", event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNewPeerRegistryDefaultTTL(t *testing.T) {
+	registry := NewPeerRegistry(0, make(chan PeerEvent))
+	if registry.ttl <= 0 {
+		t.Fatalf("expected a positive default TTL instead of %s", registry.ttl)
+	}
+}
+
+func TestPeerRegistryTinyTTL(t *testing.T) {
+	registry := NewPeerRegistry(time.Nanosecond, make(chan PeerEvent))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	registry.Run(ctx, make(chan *DiscoveredNode))
+}
+
+func TestPeerRegistryExpiresPeers(t *testing.T) {
+	discoveredNodes := make(chan *DiscoveredNode)
+	events := make(chan PeerEvent, 10)
+	registry := NewPeerRegistry(200*time.Millisecond, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go registry.Run(ctx, discoveredNodes)
+
+	address, _ := net.ResolveTCPAddr("tcp4", "10.0.10.1:8401")
+	discoveredNodes <- &DiscoveredNode{Address: address}
+	expectPeerEvent(t, events, PeerJoined, address)
+	expectPeerEvent(t, events, PeerLeft, address)
+
+	if len(registry.Peers()) != 0 {
+		t.Fatalf("expired peer should be removed from the registry")
+	}
+
+	discoveredNodes <- &DiscoveredNode{Address: address}
+	expectPeerEvent(t, events, PeerJoined, address)
+}
+
+func TestPeerRegistryClosesEvents(t *testing.T) {
+	discoveredNodes := make(chan *DiscoveredNode)
+	events := make(chan PeerEvent, 10)
+	registry := NewPeerRegistry(time.Second, events)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- registry.Run(context.Background(), discoveredNodes)
+	}()
+	close(discoveredNodes)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("PeerRegistry should stop when discovered nodes channel is closed")
+	}
+	_, open := <-events
+	if open {
+		t.Fatal("events channel should be closed when PeerRegistry stops")
+	}
+}
+
+func TestPeerRegistryFollowsNodeID(t *testing.T) {
+	discoveredNodes := make(chan *DiscoveredNode)
+	events := make(chan PeerEvent, 10)
+	registry := NewPeerRegistry(10*time.Second, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go registry.Run(ctx, discoveredNodes)
+
+	identity, err := GenerateNodeIdentity()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	nodeID := identity.Public().(ed25519.PublicKey)
+	address, _ := net.ResolveTCPAddr("tcp4", "10.0.10.1:8401")
+	newAddress, _ := net.ResolveTCPAddr("tcp4", "10.0.10.7:8401")
+
+	discoveredNodes <- &DiscoveredNode{Address: address, NodeID: nodeID}
+	expectPeerEvent(t, events, PeerJoined, address)
+	discoveredNodes <- &DiscoveredNode{Address: newAddress, NodeID: nodeID}
+	updated := expectPeerEvent(t, events, PeerUpdated, newAddress)
+	if !updated.Peer.NodeID.Equal(nodeID) {
+		t.Fatalf("expected peer NODE-ID %x instead of %x", nodeID, updated.Peer.NodeID)
+	}
+	peers := registry.Peers()
+	if len(peers) != 1 || peers[0].Address.String() != newAddress.String() {
+		t.Fatalf("expected a single peer at %s instead of %v", newAddress, peers)
+	}
+}
+
+func TestPeerRegistryRemovesLeavingPeers(t *testing.T) {
+	discoveredNodes := make(chan *DiscoveredNode)
+	events := make(chan PeerEvent, 10)
+	registry := NewPeerRegistry(time.Minute, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go registry.Run(ctx, discoveredNodes)
+
+	address, _ := net.ResolveTCPAddr("tcp4", "10.0.10.1:8401")
+	otherAddress, _ := net.ResolveTCPAddr("tcp4", "10.0.10.2:8401")
+	discoveredNodes <- &DiscoveredNode{Address: otherAddress, Leaving: true}
+	discoveredNodes <- &DiscoveredNode{Address: address}
+	expectPeerEvent(t, events, PeerJoined, address)
+	discoveredNodes <- &DiscoveredNode{Address: address, Leaving: true}
+	expectPeerEvent(t, events, PeerLeft, address)
+
+	if len(registry.Peers()) != 0 {
+		t.Fatalf("leaving peer should be removed from the registry")
+	}
+}
+
+func TestPeerRegistryUpdatesMetadata(t *testing.T) {
+	discoveredNodes := make(chan *DiscoveredNode)
+	events := make(chan PeerEvent, 10)
+	registry := NewPeerRegistry(10*time.Second, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go registry.Run(ctx, discoveredNodes)
+
+	address, _ := net.ResolveTCPAddr("tcp4", "10.0.10.1:8401")
+	discoveredNodes <- &DiscoveredNode{Address: address, Metadata: DiscoveryMetadata{Players: 1, MaxPlayers: 4}}
+	joined := expectPeerEvent(t, events, PeerJoined, address)
+	if joined.Peer.Metadata.Players != 1 {
+		t.Fatalf("expected joined peer with 1 player instead of %d", joined.Peer.Metadata.Players)
+	}
+	discoveredNodes <- &DiscoveredNode{Address: address, Metadata: DiscoveryMetadata{Players: 2, MaxPlayers: 4, InProgress: true}}
+	updated := expectPeerEvent(t, events, PeerUpdated, address)
+	if updated.Peer.Metadata.Players != 2 || !updated.Peer.Metadata.InProgress {
+		t.Fatalf("expected the peer lobby state to be updated instead of %#v", updated.Peer.Metadata)
+	}
+}
+
+func TestPeerRegistryKeepsNegotiatedVersion(t *testing.T) {
+	discoveredNodes := make(chan *DiscoveredNode)
+	events := make(chan PeerEvent, 10)
+	registry := NewPeerRegistry(10*time.Second, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go registry.Run(ctx, discoveredNodes)
+
+	address, _ := net.ResolveTCPAddr("tcp4", "10.0.10.1:8401")
+	discoveredNodes <- &DiscoveredNode{Address: address, Version: ProtocolVersion}
+	joined := expectPeerEvent(t, events, PeerJoined, address)
+	if joined.Peer.Version != ProtocolVersion {
+		t.Fatalf("expected peer version %d instead of %d", ProtocolVersion, joined.Peer.Version)
+	}
+}
+
+func TestPeerRegistryIgnoresStaleLeaving(t *testing.T) {
+	discoveredNodes := make(chan *DiscoveredNode)
+	events := make(chan PeerEvent, 10)
+	registry := NewPeerRegistry(time.Minute, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go registry.Run(ctx, discoveredNodes)
+
+	identity, err := GenerateNodeIdentity()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	nodeID := identity.Public().(ed25519.PublicKey)
+	address, _ := net.ResolveTCPAddr("tcp4", "10.0.10.1:8401")
+	announced := time.Now()
+	discoveredNodes <- &DiscoveredNode{Address: address, NodeID: nodeID, Announced: announced}
+	expectPeerEvent(t, events, PeerJoined, address)
+	discoveredNodes <- &DiscoveredNode{Address: address, NodeID: nodeID, Leaving: true, Announced: announced.Add(-time.Minute)}
+	discoveredNodes <- &DiscoveredNode{Address: address, NodeID: nodeID, Leaving: true}
+	select {
+	case event := <-events:
+		t.Fatalf("a LEAVING signed before the latest announcement should be ignored, got %s", event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+	discoveredNodes <- &DiscoveredNode{Address: address, NodeID: nodeID, Leaving: true, Announced: announced.Add(time.Second)}
+	expectPeerEvent(t, events, PeerLeft, address)
+}
+
+func TestPeerRegistryKeepsVerifiedAddresses(t *testing.T) {
+	discoveredNodes := make(chan *DiscoveredNode)
+	events := make(chan PeerEvent, 10)
+	registry := NewPeerRegistry(time.Minute, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go registry.Run(ctx, discoveredNodes)
+
+	identity, _ := GenerateNodeIdentity()
+	nodeID := identity.Public().(ed25519.PublicKey)
+	impostor, _ := GenerateNodeIdentity()
+	address, _ := net.ResolveTCPAddr("tcp4", "10.0.10.1:8401")
+
+	discoveredNodes <- &DiscoveredNode{Address: address}
+	expectPeerEvent(t, events, PeerJoined, address)
+	discoveredNodes <- &DiscoveredNode{Address: address, NodeID: nodeID}
+	left := expectPeerEvent(t, events, PeerLeft, address)
+	if left.Peer.NodeID != nil {
+		t.Fatalf("expected the unsigned entry to give way instead of %x", left.Peer.NodeID)
+	}
+	expectPeerEvent(t, events, PeerJoined, address)
+
+	discoveredNodes <- &DiscoveredNode{Address: address}
+	discoveredNodes <- &DiscoveredNode{Address: address, NodeID: impostor.Public().(ed25519.PublicKey)}
+	select {
+	case event := <-events:
+		t.Fatalf("announcements for an address a verified node holds should be ignored, got %s", event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+	peers := registry.Peers()
+	if len(peers) != 1 || !peers[0].NodeID.Equal(nodeID) {
+		t.Fatalf("expected only %x at %s instead of %v", nodeID, address, peers)
+	}
+}
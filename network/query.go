@@ -0,0 +1,73 @@
+package network
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// What a DISCOVERY request looks for. A service only answers when its
+// metadata matches every field set in the query
+type DiscoveryQuery struct {
+	Game         string `cbor:"1,keyasint,omitempty"`
+	LobbyID      string `cbor:"2,keyasint,omitempty"`
+	Language     string `cbor:"3,keyasint,omitempty"`
+	MinFreeSlots uint16 `cbor:"4,keyasint,omitempty"`
+}
+
+func (query DiscoveryQuery) IsZero() bool {
+	return query == DiscoveryQuery{}
+}
+
+func (query DiscoveryQuery) Matches(metadata DiscoveryMetadata) bool {
+	if query.Game != "" && query.Game != metadata.Game {
+		return false
+	}
+	if query.LobbyID != "" && query.LobbyID != metadata.LobbyID {
+		return false
+	}
+	//Language tags are case insensitive, en-US and en-us are the same language
+	if query.Language != "" && !strings.EqualFold(query.Language, metadata.Language) {
+		return false
+	}
+	//A lobby that doesn't advertise its capacity can't promise free slots
+	if query.MinFreeSlots > 0 && metadata.FreeSlots() < int(query.MinFreeSlots) {
+		return false
+	}
+	return true
+}
+
+func (query DiscoveryQuery) Validate() error {
+	return validateDetailHeaders([][2]string{{"GAME", query.Game}, {"LOBBY-ID", query.LobbyID}, {"LANGUAGE", query.Language}})
+}
+
+func appendQueryHeaders(headers []string, query DiscoveryQuery) []string {
+	if query.Game != "" {
+		headers = append(headers, fmt.Sprintf("GAME: %s", query.Game))
+	}
+	if query.LobbyID != "" {
+		headers = append(headers, fmt.Sprintf("LOBBY-ID: %s", query.LobbyID))
+	}
+	if query.Language != "" {
+		headers = append(headers, fmt.Sprintf("LANGUAGE: %s", query.Language))
+	}
+	if query.MinFreeSlots > 0 {
+		headers = append(headers, fmt.Sprintf("MIN-FREE-SLOTS: %d", query.MinFreeSlots))
+	}
+	return headers
+}
+
+func parseQueryHeaders(headers map[string]string) (query DiscoveryQuery, err error) {
+	query.Game = headers["GAME"]
+	query.LobbyID = headers["LOBBY-ID"]
+	query.Language = headers["LANGUAGE"]
+	if minFreeSlots, ok := headers["MIN-FREE-SLOTS"]; ok {
+		var slots uint64
+		slots, err = strconv.ParseUint(minFreeSlots, 10, 16)
+		if err != nil {
+			return query, &InvalidHeaderValueError{"MIN-FREE-SLOTS", minFreeSlots, err}
+		}
+		query.MinFreeSlots = uint16(slots)
+	}
+	return
+}
@@ -0,0 +1,178 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryQueryMatches(t *testing.T) {
+	metadata := DiscoveryMetadata{Game: "coop", LobbyID: "42", Language: "pt-BR", Players: 2, MaxPlayers: 4}
+	matching := []DiscoveryQuery{
+		{},
+		{Game: "coop"},
+		{LobbyID: "42"},
+		{Language: "pt-br"},
+		{MinFreeSlots: 2},
+		{Game: "coop", LobbyID: "42", Language: "pt-BR", MinFreeSlots: 1},
+	}
+	for _, query := range matching {
+		if !query.Matches(metadata) {
+			t.Fatalf("expected %#v to match %#v", query, metadata)
+		}
+	}
+	notMatching := []DiscoveryQuery{
+		{Game: "deathmatch"},
+		{LobbyID: "43"},
+		{Language: "en"},
+		{MinFreeSlots: 3},
+		{Game: "coop", LobbyID: "43"},
+	}
+	for _, query := range notMatching {
+		if query.Matches(metadata) {
+			t.Fatalf("expected %#v not to match %#v", query, metadata)
+		}
+	}
+	if (DiscoveryQuery{MinFreeSlots: 1}).Matches(DiscoveryMetadata{Players: 1}) {
+		t.Fatal("a lobby without MAX-PLAYERS should not match MIN-FREE-SLOTS")
+	}
+}
+
+func TestDiscoveryQueryHeaders(t *testing.T) {
+	packet := NewRequestDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8400)
+	packet.Query = DiscoveryQuery{Game: "coop", LobbyID: "42", Language: "en", MinFreeSlots: 2}
+	packetString, err := packet.String()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectedString := "DYLLABLE-DISCOVERY\r\n" +
+		"TYPE: DISCOVERY\r\n" +
+		"HOST: 127.0.0.1:8400\r\n" +
+		"VERSION: 1\r\n" +
+		"GAME: coop\r\n" +
+		"LOBBY-ID: 42\r\n" +
+		"LANGUAGE: en\r\n" +
+		"MIN-FREE-SLOTS: 2\r\n" +
+		"\r\n"
+	if packetString != expectedString {
+		t.Fatalf("expected packet:\n%#v\ninstead of:\n%#v", expectedString, packetString)
+	}
+
+	for _, codec := range []Codec{TextCodec{}, BinaryCodec{}} {
+		packetBytes, err := codec.Encode(&packet)
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		parsed, err := codec.Decode(bytes.NewBuffer(packetBytes))
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		discoveryPacket := parsed.(*DiscoveryPacket)
+		if discoveryPacket.Query != packet.Query {
+			t.Fatalf("%T: expected query %#v instead of %#v", codec, packet.Query, discoveryPacket.Query)
+		}
+		if !discoveryPacket.Metadata.IsZero() {
+			t.Fatalf("%T: the query of a request should not be parsed as metadata: %#v", codec, discoveryPacket.Metadata)
+		}
+	}
+
+	invalidPacket := "DYLLABLE-DISCOVERY\r\n" +
+		"TYPE: DISCOVERY\r\n" +
+		"HOST: 127.0.0.1:8400\r\n" +
+		"MIN-FREE-SLOTS: some\r\n" +
+		"\r\n"
+	_, err = ParsePacket(bytes.NewBufferString(invalidPacket))
+	if !errors.Is(err, ErrMalformedPacket) {
+		t.Fatalf("expected ErrMalformedPacket for an invalid MIN-FREE-SLOTS instead of %v", err)
+	}
+}
+
+func TestDiscoveryServiceAnswersMatchingQueries(t *testing.T) {
+	serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	clientConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clientConn.Close()
+	serviceSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8430}
+	metadata := DiscoveryMetadata{Game: "coop", LobbyID: "friend", Players: 3, MaxPlayers: 4}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serviceNodes := make(chan *DiscoveredNode, 4)
+	go serveDiscovery(ctx, serviceConn, DiscoveryConfig{Metadata: func() DiscoveryMetadata { return metadata }}, serviceNodes, serviceSocket)
+
+	answered := func(query DiscoveryQuery) bool {
+		request := NewRequestDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8431)
+		request.Query = query
+		requestBytes, _ := request.Bytes()
+		clientConn.WriteTo(requestBytes, serviceConn.LocalAddr())
+		readBuffer := make([]byte, bufferSize)
+		clientConn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, _, err := clientConn.ReadFrom(readBuffer)
+		//Let the rate limit of this source pass before the next request
+		time.Sleep(DefaultDiscoveryConfig.ReplyInterval)
+		return err == nil
+	}
+	if answered(DiscoveryQuery{LobbyID: "stranger"}) {
+		t.Fatal("DiscoveryService should not answer a query for another lobby")
+	}
+	if answered(DiscoveryQuery{Game: "coop", MinFreeSlots: 2}) {
+		t.Fatal("DiscoveryService should not answer a query for more slots than it has")
+	}
+	if !answered(DiscoveryQuery{Game: "coop", LobbyID: "friend", MinFreeSlots: 1}) {
+		t.Fatal("DiscoveryService should answer a matching query")
+	}
+}
+
+func TestLookForNodesFiltersResponses(t *testing.T) {
+	lookupConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	legacyConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer legacyConn.Close()
+	lookupSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8432}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lookupNodes := make(chan *DiscoveredNode, 4)
+	go lookForNodes(ctx, lookupConn, DiscoveryConfig{Query: DiscoveryQuery{Game: "coop"}}, lookupNodes, legacyConn.LocalAddr().(*net.UDPAddr), lookupSocket, nil)
+
+	//A service that ignores queries answers with every lobby it knows
+	readBuffer := make([]byte, bufferSize)
+	legacyConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, addr, err := legacyConn.ReadFrom(readBuffer)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for port, game := range map[uint16]string{8433: "deathmatch", 8434: "coop"} {
+		response := NewResponseDiscoveryPacket(net.IPv4(127, 0, 0, 1), port)
+		response.Metadata.Game = game
+		responseBytes, _ := response.Bytes()
+		legacyConn.WriteTo(responseBytes, addr)
+	}
+
+	select {
+	case node := <-lookupNodes:
+		if node.Address.Port != 8434 {
+			t.Fatalf("expected only the coop lobby to be discovered instead of %s", node)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("LookForNodes did not discover the matching lobby")
+	}
+	select {
+	case node := <-lookupNodes:
+		t.Fatalf("LookForNodes should drop lobbies not matching its query: %s", node)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,138 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ReconnectConfig struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	//Fraction of the backoff randomly added or removed, so peers that dropped together don't redial together
+	Jitter float64
+	//How long a peer remembers responses to answer replayed requests without running them again
+	ReplayWindow time.Duration
+}
+
+var DefaultReconnectConfig = ReconnectConfig{
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	ReplayWindow:   time.Minute,
+}
+
+// Responses are only replayed to the peer that sent the request
+type replayKey struct {
+	peer        string
+	requestUUID uuid.UUID
+}
+
+type replayedResponse struct {
+	done     chan struct{}
+	response ResponseActionPacket
+	expires  time.Time
+}
+
+// Zero fields fall back to DefaultReconnectConfig, a Jitter of 1 or more is capped at maxJitter
+func (config ReconnectConfig) orDefault() ReconnectConfig {
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = DefaultReconnectConfig.InitialBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultReconnectConfig.MaxBackoff
+	}
+	if config.Multiplier < 1 {
+		config.Multiplier = DefaultReconnectConfig.Multiplier
+	}
+	if config.Jitter <= 0 {
+		config.Jitter = DefaultReconnectConfig.Jitter
+	}
+	if config.Jitter > maxJitter {
+		config.Jitter = maxJitter
+	}
+	if config.ReplayWindow <= 0 {
+		config.ReplayWindow = DefaultReconnectConfig.ReplayWindow
+	}
+	return config
+}
+
+func (config ReconnectConfig) Backoff(attempt int) time.Duration {
+	config = config.orDefault()
+	backoff := math.Min(float64(config.InitialBackoff)*math.Pow(config.Multiplier, float64(attempt)), float64(config.MaxBackoff))
+	backoff *= 1 + config.Jitter*(2*rand.Float64()-1)
+	return time.Duration(backoff)
+}
+
+// Answers a replayed RequestUUID with the response of its first delivery instead of running the action twice
+func ReplayMiddleware(window time.Duration) ActionMiddleware {
+	var mutex sync.Mutex
+	responses := make(map[replayKey]*replayedResponse)
+	//Every response is kept for the same window, so they expire in the order they completed
+	var expiring []replayKey
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+			now := time.Now()
+			key := replayKey{replayingPeer(ctx), request.RequestUUID}
+			mutex.Lock()
+			for len(expiring) > 0 && now.After(responses[expiring[0]].expires) {
+				delete(responses, expiring[0])
+				expiring = expiring[1:]
+			}
+			replayed, ok := responses[key]
+			if !ok {
+				replayed = &replayedResponse{done: make(chan struct{})}
+				responses[key] = replayed
+			}
+			mutex.Unlock()
+
+			if ok {
+				select {
+				case <-replayed.done:
+					return replayed.response
+				case <-ctx.Done():
+					return NewErrorResponseActionPacket(request.RequestUUID, ctx.Err())
+				}
+			}
+
+			completed := false
+			defer func() {
+				mutex.Lock()
+				if completed {
+					replayed.expires = time.Now().Add(window)
+					expiring = append(expiring, key)
+				} else {
+					replayed.response = NewErrorResponseActionPacket(request.RequestUUID, fmt.Errorf("action %d failed", request.ActionId))
+					delete(responses, key)
+				}
+				mutex.Unlock()
+				close(replayed.done)
+			}()
+			replayed.response = next(ctx, request)
+			completed = true
+			return replayed.response
+		}
+	}
+}
+
+// The NODE-ID of a session, or the remote IP since a redial comes from another port
+func replayingPeer(ctx context.Context) string {
+	if nodeID, ok := NodeIDFromContext(ctx); ok && nodeID != nil {
+		return FormatNodeID(nodeID)
+	}
+	if addr, ok := RemoteAddrFromContext(ctx); ok {
+		if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+			return tcpAddr.IP.String()
+		}
+		return addr.String()
+	}
+	return ""
+}
@@ -0,0 +1,271 @@
+package network
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	config := ReconnectConfig{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2, Jitter: 0.2}
+	var expected = map[int]time.Duration{
+		0:  100 * time.Millisecond,
+		1:  200 * time.Millisecond,
+		3:  800 * time.Millisecond,
+		10: time.Second,
+	}
+	for attempt, backoff := range expected {
+		for i := 0; i < 20; i++ {
+			jittered := config.Backoff(attempt)
+			if jittered < backoff*8/10 || jittered > backoff*12/10 {
+				t.Fatalf("expected backoff %s ±20%% for attempt %d instead of %s", backoff, attempt, jittered)
+			}
+		}
+	}
+
+	config.Jitter = 5
+	for i := 0; i < 100; i++ {
+		if backoff := config.Backoff(0); backoff <= 0 {
+			t.Fatalf("a jitter over 1 should still leave a positive backoff, got %s", backoff)
+		}
+	}
+}
+
+func TestReplayMiddleware(t *testing.T) {
+	var runs int32
+	release := make(chan struct{})
+	router := NewActionRouter()
+	router.Use(ReplayMiddleware(time.Minute))
+	router.Handle(1, func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+		<-release
+		return NewResponseActionPacket(request.RequestUUID, true, map[string]interface{}{"run": float64(atomic.AddInt32(&runs, 1))})
+	})
+
+	request := NewRequestActionPacket(1, nil)
+	responses := make(chan ResponseActionPacket, 2)
+	var dispatching sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		dispatching.Add(1)
+		go func() {
+			defer dispatching.Done()
+			responses <- router.Dispatch(context.Background(), &request)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	dispatching.Wait()
+	close(responses)
+	for response := range responses {
+		if !response.Approved || response.Content["run"] != 1.0 {
+			t.Fatalf("replayed request should get the response of the first run instead of %v", response.Content)
+		}
+	}
+
+	replayed := router.Dispatch(context.Background(), &request)
+	other := NewRequestActionPacket(1, nil)
+	response := router.Dispatch(context.Background(), &other)
+	if replayed.Content["run"] != 1.0 || response.Content["run"] != 2.0 {
+		t.Fatalf("expected only a new RequestUUID to run the action again instead of %v and %v", replayed.Content, response.Content)
+	}
+}
+
+func TestReplayMiddlewareSeparatesPeers(t *testing.T) {
+	var runs int32
+	handler := ReplayMiddleware(time.Minute)(func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+		return NewResponseActionPacket(request.RequestUUID, true, map[string]interface{}{"run": float64(atomic.AddInt32(&runs, 1))})
+	})
+	request := RequestActionPacket{RequestUUID: uuid.New(), ActionId: 1}
+	peerCtx := context.WithValue(context.Background(), remoteAddrKey{}, &net.TCPAddr{IP: net.IPv4(10, 0, 10, 1), Port: 50000})
+	redialedCtx := context.WithValue(context.Background(), remoteAddrKey{}, &net.TCPAddr{IP: net.IPv4(10, 0, 10, 1), Port: 50001})
+	otherCtx := context.WithValue(context.Background(), remoteAddrKey{}, &net.TCPAddr{IP: net.IPv4(10, 0, 10, 2), Port: 50000})
+
+	handler(peerCtx, &request)
+	replayed := handler(redialedCtx, &request)
+	other := handler(otherCtx, &request)
+	if replayed.Content["run"] != 1.0 {
+		t.Fatalf("a peer redialing from another port should get its first response instead of %v", replayed.Content)
+	}
+	if other.Content["run"] != 2.0 {
+		t.Fatalf("another peer should not be served a cached response, got %v", other.Content)
+	}
+}
+
+func TestReplayMiddlewareForgetsAfterWindow(t *testing.T) {
+	var runs int32
+	handler := ReplayMiddleware(10 * time.Millisecond)(func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+		atomic.AddInt32(&runs, 1)
+		return NewResponseActionPacket(request.RequestUUID, true, nil)
+	})
+	request := RequestActionPacket{RequestUUID: uuid.New(), ActionId: 1}
+	handler(context.Background(), &request)
+	time.Sleep(20 * time.Millisecond)
+	handler(context.Background(), &request)
+	if runs != 2 {
+		t.Fatalf("expected request to run again after the replay window instead of %d runs", runs)
+	}
+}
+
+func TestReplayMiddlewareKeepsLaterResponses(t *testing.T) {
+	var runs int32
+	handler := ReplayMiddleware(50 * time.Millisecond)(func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+		atomic.AddInt32(&runs, 1)
+		return NewResponseActionPacket(request.RequestUUID, true, nil)
+	})
+	earlier := RequestActionPacket{RequestUUID: uuid.New(), ActionId: 1}
+	later := RequestActionPacket{RequestUUID: uuid.New(), ActionId: 1}
+	handler(context.Background(), &earlier)
+	time.Sleep(30 * time.Millisecond)
+	handler(context.Background(), &later)
+	time.Sleep(30 * time.Millisecond)
+	handler(context.Background(), &later)
+	if runs != 2 {
+		t.Fatalf("a response still in its window should be replayed after older ones expire, got %d runs", runs)
+	}
+	handler(context.Background(), &earlier)
+	if runs != 3 {
+		t.Fatalf("expected the expired request to run again instead of %d runs", runs)
+	}
+}
+
+func TestNodeReconnectsAndReplaysRequests(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8420")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	reconnect := ReconnectConfig{InitialBackoff: 10 * time.Millisecond}
+
+	var runs int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	//Only the caller redials, the replay is still recognized by the peer
+	serverNode := newTestNode(t, multicastGroup, config, nil)
+	serverNode.Router.Handle(1, func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return NewResponseActionPacket(request.RequestUUID, true, nil)
+	})
+	err = serverNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer serverNode.Stop()
+
+	events := make(chan PeerEvent, 10)
+	clientNode := newTestNode(t, multicastGroup, config, events)
+	clientNode.config.Reconnect = &reconnect
+	clientNode = NewNode(clientNode.config, nil)
+	err = clientNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clientNode.Stop()
+
+	var peer *net.TCPAddr
+	select {
+	case event := <-events:
+		peer = event.Peer.Address
+	case <-time.After(time.Second):
+		t.Fatal("client node did not discover the server node")
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		response, err := clientNode.Call(context.Background(), peer, 1, nil)
+		if err == nil && !response.Approved {
+			t.Errorf("expected replayed request to be approved")
+		}
+		result <- err
+	}()
+
+	<-started
+	clientNode.mutex.Lock()
+	dropped := clientNode.connections[peer.String()]
+	clientNode.mutex.Unlock()
+	dropped.conn.Close()
+	<-dropped.done
+
+	//Let the replay reach the server before the first delivery finishes
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	select {
+	case err = <-result:
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("call was not replayed after reconnecting")
+	}
+	if runs != 1 {
+		t.Fatalf("replayed request should run once on the peer instead of %d times", runs)
+	}
+
+	clientNode.mutex.Lock()
+	reconnected, ok := clientNode.connections[peer.String()]
+	clientNode.mutex.Unlock()
+	if !ok || reconnected == dropped {
+		t.Fatal("node should have redialed the dropped peer")
+	}
+}
+
+func TestNodeReturnsErrorsThatAreNotReplayable(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8440")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	serverNode := newTestNode(t, multicastGroup, config, nil)
+	serverNode.Router.Handle(1, echoHandler)
+	err = serverNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer serverNode.Stop()
+
+	clientNode := newTestNode(t, multicastGroup, config, nil)
+	clientNode.config.Reconnect = &ReconnectConfig{}
+	clientNode = NewNode(clientNode.config, nil)
+	err = clientNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := clientNode.Call(context.Background(), serverNode.AppSocket(), 1, map[string]interface{}{"score": math.Inf(1)})
+		result <- err
+	}()
+	select {
+	case err = <-result:
+		if err == nil {
+			t.Fatal("expected parameters that can't be encoded to fail the call")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a request that can't be encoded should not wait for its connection to be redialed")
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- clientNode.Stop() }()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("node did not stop after a failed call")
+	}
+}
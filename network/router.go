@@ -0,0 +1,304 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ActionHandler func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket
+
+type ActionMiddleware func(next ActionHandler) ActionHandler
+
+type ActionRouter struct {
+	mutex        sync.RWMutex
+	handlers     map[uint8]ActionHandler
+	middleware   []ActionMiddleware
+	codec        Codec
+	drainTimeout time.Duration
+}
+
+type remoteAddrKey struct{}
+
+// The values of a serving context without its cancellation, so actions in flight outlive it
+type detachedContext struct {
+	parent context.Context
+}
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+func NewActionRouter() *ActionRouter {
+	return &ActionRouter{handlers: make(map[uint8]ActionHandler), codec: DefaultCodec}
+}
+
+func NewErrorResponseActionPacket(requestUUID uuid.UUID, err error) ResponseActionPacket {
+	return NewResponseActionPacket(requestUUID, false, map[string]interface{}{"error": err.Error()})
+}
+
+func RemoteAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(remoteAddrKey{}).(net.Addr)
+	return addr, ok
+}
+
+func (router *ActionRouter) Handle(actionId uint8, handler ActionHandler) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	router.handlers[actionId] = handler
+}
+
+func (router *ActionRouter) Use(middleware ...ActionMiddleware) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	router.middleware = append(router.middleware, middleware...)
+}
+
+func (router *ActionRouter) SetCodec(codec Codec) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	router.codec = codec
+}
+
+// How long actions in flight are given to finish once serving stops before
+// their context is cancelled. Zero waits for them however long they take
+func (router *ActionRouter) SetDrainTimeout(timeout time.Duration) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	router.drainTimeout = timeout
+}
+
+func (router *ActionRouter) Dispatch(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+	err := CheckVersion(request.Version)
+	if err != nil {
+		return NewErrorResponseActionPacket(request.RequestUUID, err)
+	}
+	router.mutex.RLock()
+	handler := router.route
+	for i := len(router.middleware) - 1; i >= 0; i-- {
+		handler = router.middleware[i](handler)
+	}
+	router.mutex.RUnlock()
+	return recoverHandler(handler)(ctx, request)
+}
+
+func (router *ActionRouter) Serve(ctx context.Context, listener net.Listener) (err error) {
+	var serving sync.WaitGroup
+	defer serving.Wait()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		var conn net.Conn
+		conn, err = listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return
+		}
+		serving.Add(1)
+		go func() {
+			defer serving.Done()
+			defer conn.Close()
+			router.ServeConn(ctx, conn)
+		}()
+	}
+}
+
+func (router *ActionRouter) ServeConn(ctx context.Context, conn io.ReadWriter) (err error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			return
+		}
+		ctx = context.WithValue(ctx, nodeIDKey{}, PeerNodeID(tlsConn.ConnectionState()))
+	}
+	netConn, ok := conn.(net.Conn)
+	if ok {
+		ctx = context.WithValue(ctx, remoteAddrKey{}, netConn.RemoteAddr())
+	}
+
+	router.mutex.RLock()
+	codec := router.codec
+	drainTimeout := router.drainTimeout
+	router.mutex.RUnlock()
+	handlerCtx, cancelHandlers := context.WithCancel(detachedContext{ctx})
+	defer cancelHandlers()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+			return
+		}
+		//No more requests are read, the ones in flight drain before their replies are written
+		if netConn != nil {
+			netConn.SetReadDeadline(time.Now())
+		}
+		if drainTimeout <= 0 {
+			return
+		}
+		timer := time.NewTimer(drainTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancelHandlers()
+		case <-stop:
+		}
+	}()
+
+	decoder := NewPacketDecoder(conn)
+	decoder.SetCodec(codec)
+	encoder := NewPacketEncoder(conn)
+	var writeMutex sync.Mutex
+	var handling sync.WaitGroup
+	defer handling.Wait()
+
+	for {
+		var packet Packet
+		packet, err = decoder.Decode()
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return
+		}
+		replyCodec := decoder.Codec()
+		if heartbeat, ok := packet.(*HeartbeatPacket); ok && heartbeat.Type == pingHeartbeatType {
+			pong := NewPongPacket(heartbeat)
+			writeMutex.Lock()
+			encoder.SetCodec(replyCodec)
+			encoder.Encode(&pong)
+			writeMutex.Unlock()
+			continue
+		}
+		request, ok := packet.(*RequestActionPacket)
+		if !ok {
+			continue
+		}
+		handling.Add(1)
+		go func() {
+			defer handling.Done()
+			response := router.Dispatch(handlerCtx, request)
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			encoder.SetCodec(replyCodec)
+			encoder.Encode(&response)
+		}()
+	}
+}
+
+func (ctx detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (ctx detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (ctx detachedContext) Err() error {
+	return nil
+}
+
+func (ctx detachedContext) Value(key interface{}) interface{} {
+	return ctx.parent.Value(key)
+}
+
+func (router *ActionRouter) route(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+	router.mutex.RLock()
+	handler, ok := router.handlers[request.ActionId]
+	router.mutex.RUnlock()
+	if !ok {
+		return NewErrorResponseActionPacket(request.RequestUUID, fmt.Errorf("unknown action %d", request.ActionId))
+	}
+	return handler(ctx, request)
+}
+
+func recoverHandler(next ActionHandler) ActionHandler {
+	return func(ctx context.Context, request *RequestActionPacket) (response ResponseActionPacket) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				response = NewErrorResponseActionPacket(request.RequestUUID, fmt.Errorf("action %d failed: %v", request.ActionId, recovered))
+			}
+		}()
+		response = next(ctx, request)
+		response.RequestUUID = request.RequestUUID
+		response.Version = request.Version
+		return
+	}
+}
+
+func LoggingMiddleware(logger *log.Logger) ActionMiddleware {
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+			start := time.Now()
+			response := next(ctx, request)
+			remote := "unknown"
+			if addr, ok := RemoteAddrFromContext(ctx); ok {
+				remote = addr.String()
+			}
+			logger.Printf("action %d from %s request %s approved=%v in %s", request.ActionId, remote, request.RequestUUID, response.Approved, time.Since(start))
+			return response
+		}
+	}
+}
+
+func AuthMiddleware(authorize func(ctx context.Context, request *RequestActionPacket) error) ActionMiddleware {
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+			err := authorize(ctx, request)
+			if err != nil {
+				return NewErrorResponseActionPacket(request.RequestUUID, err)
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+func RateLimitMiddleware(limit int, interval time.Duration) ActionMiddleware {
+	type window struct {
+		start time.Time
+		count int
+	}
+	var mutex sync.Mutex
+	windows := make(map[string]*window)
+
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+			key := ""
+			if addr, ok := RemoteAddrFromContext(ctx); ok {
+				key = addr.String()
+			}
+			now := time.Now()
+			mutex.Lock()
+			current, ok := windows[key]
+			if !ok || now.Sub(current.start) >= interval {
+				for windowKey, expired := range windows {
+					if now.Sub(expired.start) >= interval {
+						delete(windows, windowKey)
+					}
+				}
+				current = &window{start: now}
+				windows[key] = current
+			}
+			current.count++
+			limited := current.count > limit
+			mutex.Unlock()
+			if limited {
+				return NewErrorResponseActionPacket(request.RequestUUID, ErrRateLimited)
+			}
+			return next(ctx, request)
+		}
+	}
+}
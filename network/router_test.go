@@ -0,0 +1,219 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func echoHandler(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+	return NewResponseActionPacket(request.RequestUUID, true, request.Parameters)
+}
+
+func TestActionRouterDispatch(t *testing.T) {
+	router := NewActionRouter()
+	router.Handle(1, echoHandler)
+
+	request := NewRequestActionPacket(1, map[string]interface{}{"key": "value"})
+	response := router.Dispatch(context.Background(), &request)
+	if !response.Approved {
+		t.Fatalf("expected approved response instead of %v", response.Content)
+	}
+	if response.RequestUUID != request.RequestUUID {
+		t.Fatalf("expected response REQUEST-UUID equals to \"%s\" instead of \"%s\"", request.RequestUUID, response.RequestUUID)
+	}
+	if response.Content["key"] != "value" {
+		t.Fatalf("unexpected response content %v", response.Content)
+	}
+}
+
+func TestActionRouterUnknownAction(t *testing.T) {
+	router := NewActionRouter()
+	request := NewRequestActionPacket(42, nil)
+	response := router.Dispatch(context.Background(), &request)
+	if response.Approved {
+		t.Fatal("unknown action should not be approved")
+	}
+	if response.RequestUUID != request.RequestUUID {
+		t.Fatalf("expected response REQUEST-UUID equals to \"%s\" instead of \"%s\"", request.RequestUUID, response.RequestUUID)
+	}
+	if response.Content["error"] != "unknown action 42" {
+		t.Fatalf("unexpected error body %v", response.Content)
+	}
+}
+
+func TestActionRouterIncompatibleVersion(t *testing.T) {
+	router := NewActionRouter()
+	router.Handle(1, echoHandler)
+
+	request := NewRequestActionPacket(1, nil)
+	request.Version = ProtocolVersion + 1
+	response := router.Dispatch(context.Background(), &request)
+	if response.Approved {
+		t.Fatal("request without a compatible version should not be approved")
+	}
+	var versionErr *IncompatibleVersionError
+	if !errors.As(CheckVersion(request.Version), &versionErr) || response.Content["error"] != versionErr.Error() {
+		t.Fatalf("unexpected error body %v", response.Content)
+	}
+
+	request = NewRequestActionPacket(1, nil)
+	response = router.Dispatch(context.Background(), &request)
+	if !response.Approved || response.Version != request.Version {
+		t.Fatalf("expected approved response with version %d instead of %v", request.Version, response)
+	}
+
+	request.Version = 0
+	response = router.Dispatch(context.Background(), &request)
+	if !response.Approved {
+		t.Fatalf("a request without VERSION is version 1 and should be approved, got %v", response.Content)
+	}
+}
+
+func TestActionRouterHandlerPanic(t *testing.T) {
+	router := NewActionRouter()
+	router.Handle(1, func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+		panic("boom")
+	})
+	request := NewRequestActionPacket(1, nil)
+	response := router.Dispatch(context.Background(), &request)
+	if response.Approved {
+		t.Fatal("panicking handler should not be approved")
+	}
+	if response.Content["error"] != "action 1 failed: boom" {
+		t.Fatalf("unexpected error body %v", response.Content)
+	}
+}
+
+func TestActionRouterMiddlewareOrder(t *testing.T) {
+	var calls []string
+	tracing := func(name string) ActionMiddleware {
+		return func(next ActionHandler) ActionHandler {
+			return func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+				calls = append(calls, name)
+				return next(ctx, request)
+			}
+		}
+	}
+	router := NewActionRouter()
+	router.Use(tracing("first"), tracing("second"))
+	router.Handle(1, echoHandler)
+
+	request := NewRequestActionPacket(1, nil)
+	router.Dispatch(context.Background(), &request)
+	if strings.Join(calls, ",") != "first,second" {
+		t.Fatalf("expected middleware to run in registration order instead of %v", calls)
+	}
+}
+
+func TestActionRouterAuthMiddleware(t *testing.T) {
+	router := NewActionRouter()
+	router.Use(AuthMiddleware(func(ctx context.Context, request *RequestActionPacket) error {
+		if request.Parameters["token"] != "secret" {
+			return errors.New("not authorized")
+		}
+		return nil
+	}))
+	router.Handle(1, echoHandler)
+
+	request := NewRequestActionPacket(1, map[string]interface{}{"token": "wrong"})
+	response := router.Dispatch(context.Background(), &request)
+	if response.Approved || response.Content["error"] != "not authorized" {
+		t.Fatalf("expected request to be rejected instead of %v", response.Content)
+	}
+	request = NewRequestActionPacket(1, map[string]interface{}{"token": "secret"})
+	response = router.Dispatch(context.Background(), &request)
+	if !response.Approved {
+		t.Fatalf("expected request to be approved instead of %v", response.Content)
+	}
+}
+
+func TestActionRouterRateLimitMiddleware(t *testing.T) {
+	router := NewActionRouter()
+	router.Use(RateLimitMiddleware(2, 200*time.Millisecond))
+	router.Handle(1, echoHandler)
+
+	for i := 0; i < 2; i++ {
+		request := NewRequestActionPacket(1, nil)
+		if response := router.Dispatch(context.Background(), &request); !response.Approved {
+			t.Fatalf("%d: expected request to be approved instead of %v", i, response.Content)
+		}
+	}
+	request := NewRequestActionPacket(1, nil)
+	response := router.Dispatch(context.Background(), &request)
+	if response.Approved || response.Content["error"] != ErrRateLimited.Error() {
+		t.Fatalf("expected request to be rate limited instead of %v", response.Content)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	request = NewRequestActionPacket(1, nil)
+	if response := router.Dispatch(context.Background(), &request); !response.Approved {
+		t.Fatalf("expected request to be approved after the window instead of %v", response.Content)
+	}
+}
+
+func TestActionRouterLoggingMiddleware(t *testing.T) {
+	var output bytes.Buffer
+	router := NewActionRouter()
+	router.Use(LoggingMiddleware(log.New(&output, "", 0)))
+	router.Handle(1, echoHandler)
+
+	request := NewRequestActionPacket(1, nil)
+	router.Dispatch(context.Background(), &request)
+	if !strings.Contains(output.String(), request.RequestUUID.String()) {
+		t.Fatalf("expected the request to be logged instead of %q", output.String())
+	}
+}
+
+func TestActionRouterServe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	router := NewActionRouter()
+	router.Handle(1, echoHandler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- router.Serve(ctx, listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	client := NewActionClient(conn, time.Second)
+	go client.Serve(conn)
+
+	response, err := client.Call(context.Background(), 1, map[string]interface{}{"key": "value"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !response.Approved || response.Content["key"] != "value" {
+		t.Fatalf("unexpected response %v", response.Content)
+	}
+	response, err = client.Call(context.Background(), 2, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if response.Approved {
+		t.Fatalf("unknown action should not be approved")
+	}
+
+	cancel()
+	select {
+	case err = <-served:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled instead of %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve should return after the context is canceled")
+	}
+}
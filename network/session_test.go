@@ -0,0 +1,202 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEncryptedSession(t *testing.T) {
+	serverIdentity, _ := GenerateNodeIdentity()
+	clientIdentity, _ := GenerateNodeIdentity()
+	serverConfig, err := NewSessionTLSConfig(serverIdentity, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	clientConfig, err := NewSessionTLSConfig(clientIdentity, serverIdentity.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	router := NewActionRouter()
+	router.Handle(1, func(ctx context.Context, request *RequestActionPacket) ResponseActionPacket {
+		nodeID, ok := NodeIDFromContext(ctx)
+		return NewResponseActionPacket(request.RequestUUID, ok && nodeID.Equal(clientIdentity.Public()), nil)
+	})
+	serverConn, clientConn := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go router.ServeConn(ctx, tls.Server(serverConn, serverConfig))
+
+	conn := tls.Client(clientConn, clientConfig)
+	defer conn.Close()
+	client := NewActionClient(conn, time.Second)
+	go client.Serve(conn)
+	response, err := client.Call(context.Background(), 1, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !response.Approved {
+		t.Fatal("handler should see the client NODE-ID of the session")
+	}
+}
+
+func TestEncryptedSessionRejectsUnpinnedPeer(t *testing.T) {
+	serverIdentity, _ := GenerateNodeIdentity()
+	clientIdentity, _ := GenerateNodeIdentity()
+	impostor, _ := GenerateNodeIdentity()
+	serverConfig, _ := NewSessionTLSConfig(impostor, nil)
+	clientConfig, _ := NewSessionTLSConfig(clientIdentity, serverIdentity.Public().(ed25519.PublicKey))
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	go tls.Server(serverConn, serverConfig).Handshake()
+	err := tls.Client(clientConn, clientConfig).Handshake()
+	if !errors.Is(err, ErrPeerIdentityMismatch) {
+		t.Fatalf("expected ErrPeerIdentityMismatch instead of %v", err)
+	}
+}
+
+func TestNodeEncryptedSessions(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8418")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	serverNode := newTestNode(t, multicastGroup, config, nil)
+	serverNode.config.Encrypted = true
+	serverNode.Router.Handle(1, echoHandler)
+	err = serverNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer serverNode.Stop()
+
+	events := make(chan PeerEvent, 10)
+	clientNode := newTestNode(t, multicastGroup, config, events)
+	clientNode.config.Encrypted = true
+	err = clientNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clientNode.Stop()
+
+	_, err = clientNode.Call(context.Background(), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6666}, 1, nil)
+	if err != ErrUnknownPeerIdentity {
+		t.Fatalf("expected ErrUnknownPeerIdentity for an undiscovered peer instead of %v", err)
+	}
+
+	select {
+	case event := <-events:
+		response, err := clientNode.Call(context.Background(), event.Peer.Address, 1, map[string]interface{}{"key": "value"})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !response.Approved || response.Content["key"] != "value" {
+			t.Fatalf("unexpected response %v", response.Content)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client node did not discover the server node")
+	}
+
+	conn, err := net.Dial("tcp", serverNode.AppSocket().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	client := NewActionClient(conn, 200*time.Millisecond)
+	go client.Serve(conn)
+	_, err = client.Call(context.Background(), 1, nil)
+	if err == nil {
+		t.Fatal("plaintext call to an encrypted node should fail")
+	}
+}
+
+func TestNodeRefusesUndiscoveredSession(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8433")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	serverNode := newTestNode(t, multicastGroup, config, nil)
+	serverNode.config.Encrypted = true
+	serverNode.Router.Handle(1, echoHandler)
+	err = serverNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer serverNode.Stop()
+
+	stranger, _ := GenerateNodeIdentity()
+	sessionConfig, err := NewSessionTLSConfig(stranger, serverNode.NodeID())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	conn, err := tls.Dial("tcp", serverNode.AppSocket().String(), sessionConfig)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	client := NewActionClient(conn, 500*time.Millisecond)
+	go client.Serve(conn)
+	_, err = client.Call(context.Background(), 1, nil)
+	if err == nil {
+		t.Fatal("a node that was never discovered should not open a session")
+	}
+}
+
+func TestNodeAcceptsTrustedSession(t *testing.T) {
+	iface, err := findMulticastInterface(false)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	config := MulticastConfig{Interface: iface, TTL: 1, Loopback: true}
+	multicastGroup, err := net.ResolveUDPAddr("udp4", "239.0.84.2:8441")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tool, _ := GenerateNodeIdentity()
+	serverNode := newTestNode(t, multicastGroup, config, nil)
+	serverNode.config.Encrypted = true
+	serverNode.config.Trusted = []ed25519.PublicKey{tool.Public().(ed25519.PublicKey)}
+	serverNode.Router.Handle(1, echoHandler)
+	err = serverNode.Start(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer serverNode.Stop()
+
+	sessionConfig, err := NewSessionTLSConfig(tool, serverNode.NodeID())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	conn, err := tls.Dial("tcp", serverNode.AppSocket().String(), sessionConfig)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	client := NewActionClient(conn, 500*time.Millisecond)
+	go client.Serve(conn)
+	response, err := client.Call(context.Background(), 1, map[string]interface{}{"key": "value"})
+	if err != nil {
+		t.Fatalf("a trusted node should open a session without being discovered: %v", err)
+	}
+	if !response.Approved || response.Content["key"] != "value" {
+		t.Fatalf("unexpected response %v", response.Content)
+	}
+}
@@ -0,0 +1,87 @@
+package network
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+const signatureHeader = "SIGNATURE"
+
+var ErrInvalidSignature = errors.New("packet signature does not match")
+
+// Signs text packets with a per-lobby key. The signature covers the packet
+// bytes without the SIGNATURE header, which is added after the other headers,
+// so a discovery packet keeps its own node SIGNATURE underneath it
+type SignedCodec struct {
+	Limits PacketLimits
+	key    []byte
+}
+
+func NewSignedCodec(key []byte) *SignedCodec {
+	return &SignedCodec{key: append([]byte{}, key...)}
+}
+
+func (codec *SignedCodec) Encode(packet Packet) (out []byte, err error) {
+	packetBytes, err := packet.Bytes()
+	if err != nil {
+		return
+	}
+	headersEnd := bytes.Index(packetBytes, []byte(headerSeparator+headerSeparator))
+	if headersEnd < 0 {
+		return nil, ErrMalformedPacket
+	}
+	headersEnd += len(headerSeparator)
+	signature := signatureHeader + ": " + hex.EncodeToString(codec.sign(packetBytes)) + headerSeparator
+	out = make([]byte, 0, len(packetBytes)+len(signature))
+	out = append(out, packetBytes[:headersEnd]...)
+	out = append(out, signature...)
+	return append(out, packetBytes[headersEnd:]...), nil
+}
+
+func (codec *SignedCodec) Decode(reader io.Reader) (packet Packet, err error) {
+	frame, err := readTextFrame(bufferedReader(reader), codec.Limits)
+	if err != nil {
+		return
+	}
+	canonical, signature, err := splitSignature(frame)
+	if err != nil {
+		return
+	}
+	if !hmac.Equal(signature, codec.sign(canonical)) {
+		return nil, ErrInvalidSignature
+	}
+	return ParsePacketWithLimits(bytes.NewBuffer(canonical), codec.Limits)
+}
+
+func (codec *SignedCodec) sign(packetBytes []byte) []byte {
+	mac := hmac.New(sha256.New, codec.key)
+	mac.Write(packetBytes)
+	return mac.Sum(nil)
+}
+
+func splitSignature(frame []byte) (canonical []byte, signature []byte, err error) {
+	headersEnd := bytes.Index(frame, []byte(headerSeparator+headerSeparator))
+	if headersEnd < 0 {
+		return nil, nil, ErrTruncatedPacket
+	}
+	prefix := []byte(headerSeparator + signatureHeader + ": ")
+	start := bytes.LastIndex(frame[:headersEnd+len(headerSeparator)], prefix)
+	if start < 0 {
+		return nil, nil, &MissingHeaderError{signatureHeader}
+	}
+	start += len(headerSeparator)
+	end := start + bytes.Index(frame[start:], []byte(headerSeparator)) + len(headerSeparator)
+	value := string(frame[start+len(prefix)-len(headerSeparator) : end-len(headerSeparator)])
+	signature, err = hex.DecodeString(value)
+	if err != nil {
+		return nil, nil, &InvalidHeaderValueError{signatureHeader, value, err}
+	}
+	canonical = make([]byte, 0, len(frame)-(end-start))
+	canonical = append(canonical, frame[:start]...)
+	canonical = append(canonical, frame[end:]...)
+	return
+}
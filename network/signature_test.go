@@ -0,0 +1,113 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSignedCodec(t *testing.T) {
+	codec := NewSignedCodec([]byte("lobby secret"))
+	packets, _ := encodeTestPackets(t)
+	for i, expected := range packets {
+		packetBytes, err := codec.Encode(expected)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !bytes.Contains(packetBytes, []byte("\r\nSIGNATURE: ")) {
+			t.Fatalf("%d: expected a SIGNATURE header in\n%s", i, packetBytes)
+		}
+		packet, err := codec.Decode(bytes.NewBuffer(packetBytes))
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if discovery, ok := packet.(*DiscoveryPacket); ok {
+			discovery.Address = expected.(*DiscoveryPacket).Address
+		}
+		if !reflect.DeepEqual(packet, expected) {
+			t.Fatalf("%d: expected decoded packet %#v instead of %#v", i, expected, packet)
+		}
+
+		//Signed packets are still readable by peers that don't verify them
+		_, err = ParsePacket(bytes.NewBuffer(packetBytes))
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+}
+
+func TestSignedCodecRejectsForgedPackets(t *testing.T) {
+	codec := NewSignedCodec([]byte("lobby secret"))
+	response := NewResponseActionPacket(uuid.New(), false, map[string]interface{}{"error": "not your turn"})
+	packetBytes, _ := codec.Encode(&response)
+
+	forged := strings.Replace(string(packetBytes), "APPROVED: False", "APPROVED: True", 1)
+	_, err := codec.Decode(strings.NewReader(forged))
+	if err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature for a forged approval instead of %v", err)
+	}
+
+	_, err = NewSignedCodec([]byte("other lobby")).Decode(bytes.NewReader(packetBytes))
+	if err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature for another lobby key instead of %v", err)
+	}
+
+	unsigned, _ := response.Bytes()
+	_, err = codec.Decode(bytes.NewReader(unsigned))
+	var missingErr *MissingHeaderError
+	if !errors.As(err, &missingErr) || missingErr.Header != "SIGNATURE" {
+		t.Fatalf("expected missing SIGNATURE header instead of %v", err)
+	}
+
+	invalid := strings.Replace(string(packetBytes), "SIGNATURE: ", "SIGNATURE: zz", 1)
+	_, err = codec.Decode(strings.NewReader(invalid))
+	var invalidErr *InvalidHeaderValueError
+	if !errors.As(err, &invalidErr) || invalidErr.Header != "SIGNATURE" {
+		t.Fatalf("expected invalid SIGNATURE header instead of %v", err)
+	}
+}
+
+func TestSignedDiscoveryIgnoresForgedReplies(t *testing.T) {
+	serviceConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	forgerConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lookupConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer forgerConn.Close()
+	serviceSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8414}
+	lookupSocket := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8415}
+	codec := NewSignedCodec([]byte("lobby secret"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serviceNodes := make(chan *DiscoveredNode, 1)
+	lookupNodes := make(chan *DiscoveredNode, 2)
+	forged := NewResponseDiscoveryPacket(net.IPv4(127, 0, 0, 1), 6666)
+	forgedBytes, _ := forged.Bytes()
+	forgerConn.WriteTo(forgedBytes, lookupConn.LocalAddr())
+	go serveDiscovery(ctx, serviceConn, DiscoveryConfig{Codec: codec}, serviceNodes, serviceSocket)
+	go lookForNodes(ctx, lookupConn, DiscoveryConfig{Codec: codec}, lookupNodes, serviceConn.LocalAddr().(*net.UDPAddr), lookupSocket, nil)
+
+	select {
+	case node := <-lookupNodes:
+		if node.Address.String() != serviceSocket.String() {
+			t.Fatalf("expected only %s to be discovered instead of %s", serviceSocket, node)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("signed discovery response was not accepted")
+	}
+}
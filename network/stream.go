@@ -0,0 +1,170 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+type PacketDecoder struct {
+	reader  *bufio.Reader
+	codec   Codec
+	decoded Codec
+}
+
+type PacketEncoder struct {
+	writer io.Writer
+	codec  Codec
+}
+
+func NewPacketDecoder(reader io.Reader) *PacketDecoder {
+	return &PacketDecoder{reader: bufio.NewReaderSize(reader, bufferSize), codec: DefaultCodec}
+}
+
+func NewPacketEncoder(writer io.Writer) *PacketEncoder {
+	return &PacketEncoder{writer: writer, codec: DefaultCodec}
+}
+
+func (decoder *PacketDecoder) SetCodec(codec Codec) {
+	decoder.codec = codec
+}
+
+// Codec of the last decoded packet, so replies can use the codec chosen by the peer
+func (decoder *PacketDecoder) Codec() Codec {
+	if decoder.decoded == nil {
+		return decoder.codec
+	}
+	return decoder.decoded
+}
+
+func (decoder *PacketDecoder) Decode() (packet Packet, err error) {
+	codec, err := detectCodec(decoder.codec, decoder.reader)
+	if err != nil {
+		return
+	}
+	decoder.decoded = codec
+	return codec.Decode(decoder.reader)
+}
+
+func (encoder *PacketEncoder) Codec() Codec {
+	return encoder.codec
+}
+
+func (encoder *PacketEncoder) SetCodec(codec Codec) {
+	encoder.codec = codec
+}
+
+func (encoder *PacketEncoder) Encode(packet Packet) (err error) {
+	packetBytes, err := encoder.codec.Encode(packet)
+	if err != nil {
+		return
+	}
+	_, err = encoder.writer.Write(packetBytes)
+	return
+}
+
+func readTextFrame(reader *bufio.Reader, limits PacketLimits) (frame []byte, err error) {
+	limits = limits.orDefault()
+	identifier, err := readLine(reader, limits.MaxHeaderLength, ErrHeaderTooLong)
+	if err != nil {
+		if len(identifier) > 0 {
+			err = truncatedPacket(err)
+		}
+		return
+	}
+	frame = append(frame, identifier...)
+	headers := make(map[string]string)
+	var line []byte
+	for lines := 0; string(line) != headerSeparator; lines++ {
+		if lines > limits.MaxHeaderLines {
+			return frame, ErrTooManyHeaders
+		}
+		line, err = readLine(reader, limits.MaxHeaderLength, ErrHeaderTooLong)
+		if err != nil {
+			return frame, truncatedPacket(err)
+		}
+		frame = append(frame, line...)
+		if headerPair, headerErr := parseHeader(strings.TrimRight(string(line), headerSeparator)); headerErr == nil {
+			if _, ok := headers[headerPair[0]]; !ok {
+				headers[headerPair[0]] = headerPair[1]
+			}
+		}
+	}
+	switch strings.TrimRight(string(identifier), headerSeparator) {
+	case requestActionIdentifier, responseActionIdentifier:
+		contentLength, ok, lengthErr := parseContentLength(headers)
+		if lengthErr != nil {
+			return frame, lengthErr
+		}
+		var body []byte
+		if ok {
+			if contentLength > limits.MaxBodySize {
+				return frame, ErrBodyTooLarge
+			}
+			body = make([]byte, contentLength)
+			_, err = io.ReadFull(reader, body)
+			if err != nil {
+				return frame, truncatedPacket(err)
+			}
+			frame = append(frame, body...)
+			line, err = readLine(reader, limits.MaxHeaderLength, ErrBodyTooLarge)
+			if err != nil {
+				return frame, truncatedPacket(err)
+			}
+			frame = append(frame, line...)
+			if string(line) != headerSeparator {
+				return frame, &InvalidBodyError{errors.New("body is longer than CONTENT-LENGTH")}
+			}
+		} else {
+			// Versioned senders give a CONTENT-LENGTH with every body. Packets
+			// from before versions don't, and only the next byte tells whether
+			// a JSON body or the next packet follows, so the reader waits for it
+			if _, versioned := headers["VERSION"]; versioned || !hasBody(reader) {
+				return
+			}
+			body, err = readLine(reader, limits.MaxBodySize, ErrBodyTooLarge)
+			if err != nil {
+				return frame, truncatedPacket(err)
+			}
+			frame = append(frame, body...)
+		}
+		line, err = readLine(reader, limits.MaxHeaderLength, ErrHeaderTooLong)
+		if err != nil {
+			return frame, truncatedPacket(err)
+		}
+		frame = append(frame, line...)
+		if string(line) != endPacket {
+			err = &InvalidBodyError{errors.New("body must be followed by an empty line")}
+		}
+	}
+	return
+}
+
+func hasBody(reader *bufio.Reader) bool {
+	next, err := reader.Peek(1)
+	return err == nil && next[0] == '{'
+}
+
+func readLine(reader *bufio.Reader, maxLength int, limitErr error) (line []byte, err error) {
+	var chunk []byte
+	for !bytes.HasSuffix(line, []byte(headerSeparator)) {
+		chunk, err = reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLength+len(headerSeparator) {
+			return line, limitErr
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+	return line, nil
+}
+
+func truncatedPacket(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncatedPacket
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type chunkReader struct {
+	data      []byte
+	chunkSize int
+}
+
+func (reader *chunkReader) Read(p []byte) (int, error) {
+	if len(reader.data) == 0 {
+		return 0, io.EOF
+	}
+	size := reader.chunkSize
+	if size > len(p) {
+		size = len(p)
+	}
+	if size > len(reader.data) {
+		size = len(reader.data)
+	}
+	copy(p, reader.data[:size])
+	reader.data = reader.data[size:]
+	return size, nil
+}
+
+func encodeTestPackets(t *testing.T) ([]Packet, []byte) {
+	discoveryPacket := NewRequestDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8400)
+	requestPacket := NewRequestActionPacket(1, map[string]interface{}{"key": "value", "key2": 10.0})
+	emptyRequestPacket := NewRequestActionPacket(2, nil)
+	responsePacket := NewResponseActionPacket(uuid.New(), true, map[string]interface{}{"key": true})
+	emptyResponsePacket := NewResponseActionPacket(uuid.New(), false, nil)
+	pingPacket := NewPingPacket(7)
+	pongPacket := NewPongPacket(&pingPacket)
+	packets := []Packet{&discoveryPacket, &requestPacket, &emptyRequestPacket, &responsePacket, &emptyResponsePacket, &pingPacket, &pongPacket}
+
+	var stream bytes.Buffer
+	encoder := NewPacketEncoder(&stream)
+	for _, packet := range packets {
+		err := encoder.Encode(packet)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	return packets, stream.Bytes()
+}
+
+func TestPacketDecoderMultiplePacketsInOneRead(t *testing.T) {
+	packets, stream := encodeTestPackets(t)
+	decoder := NewPacketDecoder(bytes.NewReader(stream))
+	for i, expected := range packets {
+		packet, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(packet, expected) {
+			t.Fatalf("%d: expected decoded packet %#v instead of %#v", i, expected, packet)
+		}
+	}
+	_, err := decoder.Decode()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF after the last packet instead of %v", err)
+	}
+}
+
+func TestPacketDecoderPartialReads(t *testing.T) {
+	requestPacket := NewRequestActionPacket(1, map[string]interface{}{"key": "value"})
+	responsePacket := NewResponseActionPacket(requestPacket.RequestUUID, true, nil)
+	var stream bytes.Buffer
+	encoder := NewPacketEncoder(&stream)
+	encoder.Encode(&requestPacket)
+	encoder.Encode(&responsePacket)
+
+	decoder := NewPacketDecoder(&chunkReader{stream.Bytes(), 1})
+	packet, err := decoder.Decode()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(packet, &requestPacket) {
+		t.Fatalf("expected decoded packet %#v instead of %#v", &requestPacket, packet)
+	}
+	packet, err = decoder.Decode()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(packet, &responsePacket) {
+		t.Fatalf("expected decoded packet %#v instead of %#v", &responsePacket, packet)
+	}
+}
+
+func TestPacketDecoderOverConnection(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	requestPacket := NewRequestActionPacket(3, nil)
+	go NewPacketEncoder(client).Encode(&requestPacket)
+
+	packet, err := NewPacketDecoder(server).Decode()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(packet, &requestPacket) {
+		t.Fatalf("expected decoded packet %#v instead of %#v", &requestPacket, packet)
+	}
+}
+
+func TestPacketDecoderTruncatedPacket(t *testing.T) {
+	packet := NewRequestDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8400)
+	packetBytes, _ := packet.Bytes()
+	decoder := NewPacketDecoder(bytes.NewReader(packetBytes[:len(packetBytes)-3]))
+	_, err := decoder.Decode()
+	if err != ErrTruncatedPacket {
+		t.Fatalf("expected ErrTruncatedPacket for a truncated packet instead of %v", err)
+	}
+}
+
+func TestPacketDecoderBodyWithLineBreaks(t *testing.T) {
+	requestUUID := "95bcd112-c138-4ca6-9df9-f4c508b9c0c1"
+	body := "{\r\n\"key\": \"value\"\r\n}"
+	packetString := "DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: " + requestUUID + "\r\n" +
+		"ACTION-ID: 1\r\n" +
+		"VERSION: 1\r\n" +
+		"CONTENT-LENGTH: 20\r\n" +
+		"\r\n" +
+		body + "\r\n" +
+		"\r\n"
+	decoder := NewPacketDecoder(&chunkReader{[]byte(packetString + packetString), 1})
+	for i := 0; i < 2; i++ {
+		packet, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		requestPacket := packet.(*RequestActionPacket)
+		if requestPacket.Parameters["key"] != "value" {
+			t.Fatalf("%d: unexpected parameters %v", i, requestPacket.Parameters)
+		}
+	}
+
+	truncated := packetString[:strings.Index(packetString, body)+5]
+	_, err := NewPacketDecoder(strings.NewReader(truncated)).Decode()
+	if err != ErrTruncatedPacket {
+		t.Fatalf("expected ErrTruncatedPacket for a truncated body instead of %v", err)
+	}
+
+	longer := strings.Replace(packetString, "CONTENT-LENGTH: 20", "CONTENT-LENGTH: 19", 1)
+	_, err = NewPacketDecoder(strings.NewReader(longer)).Decode()
+	var bodyErr *InvalidBodyError
+	if !errors.As(err, &bodyErr) {
+		t.Fatalf("expected InvalidBodyError for a body longer than CONTENT-LENGTH instead of %v", err)
+	}
+}
+
+func TestPacketDecoderLegacyBodyInNextRead(t *testing.T) {
+	requestUUID := "95bcd112-c138-4ca6-9df9-f4c508b9c0c1"
+	headers := "DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: " + requestUUID + "\r\n" +
+		"ACTION-ID: 1\r\n" +
+		"\r\n"
+	emptyRequest := "DYLLABLE-ACTION-REQUEST\r\n" +
+		"REQUEST-UUID: " + requestUUID + "\r\n" +
+		"ACTION-ID: 2\r\n" +
+		"\r\n"
+	packetString := headers + "{\"key\": \"value\"}\r\n" + "\r\n" + emptyRequest
+	decoder := NewPacketDecoder(&chunkReader{[]byte(packetString), len(headers)})
+	packet, err := decoder.Decode()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if parameters := packet.(*RequestActionPacket).Parameters; parameters["key"] != "value" {
+		t.Fatalf("a body arriving after the headers should not be dropped, got parameters %v", parameters)
+	}
+	packet, err = decoder.Decode()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if request := packet.(*RequestActionPacket); request.ActionId != 2 || request.Parameters != nil {
+		t.Fatalf("expected the legacy request without body instead of %#v", request)
+	}
+}
@@ -0,0 +1,44 @@
+package network
+
+import (
+	"fmt"
+)
+
+const ProtocolVersion uint8 = 1
+const MinProtocolVersion uint8 = 1
+
+// Packets from before VERSION was sent are in the format version 1 only adds optional headers to
+const unversionedProtocolVersion uint8 = 1
+
+type IncompatibleVersionError struct {
+	Version    uint8
+	MinVersion uint8
+}
+
+func (err *IncompatibleVersionError) Error() string {
+	return fmt.Sprintf("incompatible protocol version: peer supports %d-%d, supported versions are %d-%d", err.MinVersion, err.Version, MinProtocolVersion, ProtocolVersion)
+}
+
+// A zero maxVersion stands for a peer that sent no VERSION
+func NegotiateVersion(minVersion uint8, maxVersion uint8) (uint8, error) {
+	if maxVersion == 0 {
+		minVersion, maxVersion = unversionedProtocolVersion, unversionedProtocolVersion
+	}
+	version := maxVersion
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version < minVersion || version < MinProtocolVersion {
+		return 0, &IncompatibleVersionError{maxVersion, minVersion}
+	}
+	return version, nil
+}
+
+func (packet *DiscoveryPacket) NegotiateVersion() (uint8, error) {
+	return NegotiateVersion(packet.MinVersion, packet.Version)
+}
+
+func CheckVersion(version uint8) error {
+	_, err := NegotiateVersion(version, version)
+	return err
+}
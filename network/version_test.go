@@ -0,0 +1,119 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	compatible := []struct {
+		minVersion uint8
+		maxVersion uint8
+		expected   uint8
+	}{
+		{ProtocolVersion, ProtocolVersion, ProtocolVersion},
+		{MinProtocolVersion, ProtocolVersion + 5, ProtocolVersion},
+		{1, ProtocolVersion, ProtocolVersion},
+		{0, 0, 1},
+	}
+	for _, versions := range compatible {
+		version, err := NegotiateVersion(versions.minVersion, versions.maxVersion)
+		if err != nil {
+			t.Fatalf("%d-%d: %v", versions.minVersion, versions.maxVersion, err)
+		}
+		if version != versions.expected {
+			t.Fatalf("%d-%d: expected negotiated version %d instead of %d", versions.minVersion, versions.maxVersion, versions.expected, version)
+		}
+	}
+
+	incompatible := [][2]uint8{
+		{ProtocolVersion + 1, ProtocolVersion + 2},
+	}
+	for _, versions := range incompatible {
+		_, err := NegotiateVersion(versions[0], versions[1])
+		var versionErr *IncompatibleVersionError
+		if !errors.As(err, &versionErr) {
+			t.Fatalf("%d-%d: expected IncompatibleVersionError instead of %v", versions[0], versions[1], err)
+		}
+	}
+}
+
+func TestParseVersionHeaders(t *testing.T) {
+	packetString := "DYLLABLE-DISCOVERY\r\n" +
+		"TYPE: RUNNING-APP\r\n" +
+		"HOST: 127.0.0.1:8400\r\n" +
+		"VERSION: 3\r\n" +
+		"MIN-VERSION: 1\r\n" +
+		"\r\n"
+	packet, err := ParsePacket(bytes.NewBuffer([]byte(packetString)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	discoveryPacket := packet.(*DiscoveryPacket)
+	if discoveryPacket.Version != 3 || discoveryPacket.MinVersion != 1 {
+		t.Fatalf("expected parsed versions 1-3 instead of %d-%d", discoveryPacket.MinVersion, discoveryPacket.Version)
+	}
+	version, err := discoveryPacket.NegotiateVersion()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if version != ProtocolVersion {
+		t.Fatalf("expected negotiated version %d instead of %d", ProtocolVersion, version)
+	}
+	reencoded, _ := discoveryPacket.String()
+	if reencoded != packetString {
+		t.Fatalf("expected the packet to be encoded back to\n%#v\ninstead of\n%#v", packetString, reencoded)
+	}
+
+	legacyPacket := NewResponseDiscoveryPacket(net.IPv4(127, 0, 0, 1), 8400)
+	legacyPacket.Version = 0
+	legacyPacket.MinVersion = 0
+	legacyString, _ := legacyPacket.String()
+	packet, err = ParsePacket(bytes.NewBuffer([]byte(legacyString)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	version, err = packet.(*DiscoveryPacket).NegotiateVersion()
+	if err != nil || version != 1 {
+		t.Fatalf("packet without VERSION should be version 1 instead of %d %v", version, err)
+	}
+}
+
+func TestParseInvalidVersionHeaders(t *testing.T) {
+	invalidPackets := []string{
+		"DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: RUNNING-APP\r\n" +
+			"HOST: 127.0.0.1:8400\r\n" +
+			"VERSION: 0\r\n" +
+			"\r\n",
+		"DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: RUNNING-APP\r\n" +
+			"HOST: 127.0.0.1:8400\r\n" +
+			"VERSION: 1\r\n" +
+			"MIN-VERSION: 2\r\n" +
+			"\r\n",
+		"DYLLABLE-DISCOVERY\r\n" +
+			"TYPE: RUNNING-APP\r\n" +
+			"HOST: 127.0.0.1:8400\r\n" +
+			"VERSION: 256\r\n" +
+			"\r\n",
+		"DYLLABLE-ACTION-REQUEST\r\n" +
+			"REQUEST-UUID: 95bcd112-c138-4ca6-9df9-f4c508b9c0c1\r\n" +
+			"ACTION-ID: 1\r\n" +
+			"VERSION: one\r\n" +
+			"\r\n",
+		"DYLLABLE-ACTION-RESPONSE\r\n" +
+			"REQUEST-UUID: 95bcd112-c138-4ca6-9df9-f4c508b9c0c1\r\n" +
+			"APPROVED: True\r\n" +
+			"VERSION: -1\r\n" +
+			"\r\n",
+	}
+	for _, packetString := range invalidPackets {
+		_, err := ParsePacket(bytes.NewBuffer([]byte(packetString)))
+		if err == nil {
+			t.Fatalf("following packet should be invalid: \n%s", packetString)
+		}
+	}
+}